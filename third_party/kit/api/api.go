@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// API defines a HTTP API that can be exposed using a server
+type API interface {
+	// Endpoints must return all Endpoints of the HTTP API to register with a http router
+	Endpoints() []Endpoint
+}
+
+// Endpoint defines an endpoint of a HTTP API
+type Endpoint struct {
+	// The HTTP Method of this endpoint
+	Method string
+	// The URL Path of this endpoint. Should follow the format for
+	// paths specified by https://github.com/julienschmidt/httprouter.
+	Path string
+	// The handler to invoke when a request for the given Method, Path is received
+	Handler http.Handler
+	// Any endpoint specific middlewares for this handler (i.e. access control)
+	Middlewares []Middleware
+	// The maximum duration of the handler, applied as a deadline on the request
+	// context. If the handler does not respond in time, a 504 is returned.
+	// Zero means no deadline.
+	Timeout time.Duration
+	// The maximum size of the request body in bytes. Larger requests are
+	// rejected with a 413. Zero means no limit.
+	MaxBodyBytes int64
+	// The maximum duration for writing the response, overriding that of the
+	// http.Server. Only applies to HTTP/1.x requests. Zero means no override.
+	WriteTimeout time.Duration
+	// Whether this endpoint is critical. Critical endpoints are the last to
+	// have requests shed under load, see ConcurrencyMW.
+	Critical bool
+	// Whether PUT, PATCH and DELETE requests must have an If-Match header, so
+	// clients can't overwrite changes they haven't seen. Requests without one
+	// are rejected with a 428. The handler must check the header against the
+	// resource, see CheckPreconditions.
+	RequireIfMatch bool
+	// Whether GET responses honour ?fields and ?expand, keeping only the fields
+	// and embedded resources asked for, see Expand. Requests for fields the
+	// response doesn't have are responded to with a 400.
+	SparseFields bool
+}
+
+// apis is an API made up of the endpoints of other APIs
+type apis []API
+
+// Combine returns an API with the endpoints of all the given APIs, so they can
+// be served together, i.e. NewDebugAPI and NewVersionAPI on an internal listener.
+func Combine(a ...API) API {
+	return apis(a)
+}
+
+// Endpoints implements API
+func (a apis) Endpoints() []Endpoint {
+	var endpoints []Endpoint
+	for _, api := range a {
+		endpoints = append(endpoints, api.Endpoints()...)
+	}
+	return endpoints
+}
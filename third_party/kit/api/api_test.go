@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/blendle/zapdriver"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// testAPI is an API with the given endpoints
+type testAPI []Endpoint
+
+// Endpoints implements API
+func (a testAPI) Endpoints() []Endpoint {
+	return a
+}
+
+// handleTest handles the request with a server for the given endpoints, without
+// any server wide middleware, returning the response.
+func handleTest(r *http.Request, endpoints ...Endpoint) *httptest.ResponseRecorder {
+	s := newServer(zap.NewNop().Sugar(), testAPI(endpoints), nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// logEntry is an entry logged as JSON by a testLog
+type logEntry struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	// Dropped is the number of requests not logged before this one.
+	Dropped int64 `json:"dropped"`
+	// HTTPRequest and Route are set by access logs.
+	HTTPRequest *zapdriver.HTTPPayload `json:"httpRequest"`
+	Route       string                 `json:"labels.route"`
+	// RequestID and Trace are set by request scoped loggers.
+	RequestID string `json:"request_id"`
+	Trace     string `json:"logging.googleapis.com/trace"`
+	// RequestBody and ResponseBody are set by captured requests.
+	RequestBody  string `json:"request_body"`
+	ResponseBody string `json:"response_body"`
+	// Config is set by LogConfig.
+	Config map[string]string `json:"config"`
+}
+
+// testLog is a logger recording its entries
+type testLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer
+func (l *testLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(b)
+}
+
+// logger returns a logger recording its entries to l.
+func (l *testLog) logger() *zap.SugaredLogger {
+	enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		LevelKey:       "level",
+		MessageKey:     "msg",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	})
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(l), zapcore.DebugLevel)).Sugar()
+}
+
+// entries returns the entries logged, and forgets them.
+func (l *testLog) entries() []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []logEntry
+	dec := json.NewDecoder(&l.buf)
+	for {
+		var e logEntry
+		if err := dec.Decode(&e); err != nil {
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
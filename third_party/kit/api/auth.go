@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// TokenAuthMW returns a middleware that authenticates requests by bearer token.
+// tokens maps each accepted token to the principal it identifies, which is set
+// on the request's Details. Requests without an accepted token are rejected
+// with a 401.
+func TokenAuthMW(tokens map[string]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			// Compare against every token in constant time, so the time taken
+			// doesn't reveal how close a guess was.
+			var principal string
+			for token, p := range tokens {
+				if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+					principal = p
+				}
+			}
+
+			if got == "" || principal == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				RespondError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			if d := getDetails(r); d != nil {
+				d.Principal = principal
+			}
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// ClientCertAuthMW returns a middleware that authenticates requests by the
+// client certificate verified during the TLS handshake, see NewTLSConfig. The
+// identity of the certificate, see ClientIdentity, is set as the principal on
+// the request's Details. Requests without a verified certificate are rejected
+// with a 401.
+func ClientCertAuthMW() Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				RespondError(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			if d := getDetails(r); d != nil {
+				d.Principal = ClientIdentity(r.TLS.VerifiedChains[0][0])
+			}
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
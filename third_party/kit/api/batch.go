@@ -0,0 +1,396 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// keyServer is how the server handling a request is stored and retrieved, so
+// batches can dispatch their sub-requests to it
+const keyServer ctxKey = 5
+
+// keyBatch is how the Details of a batch request are stored on the context of
+// its sub-requests
+const keyBatch ctxKey = 6
+
+// The defaults of BatchOptions
+const (
+	defaultMaxBatchRequests    = 100
+	defaultMaxBatchBodyBytes   = 1 << 20
+	defaultMaxBatchRequestBody = 64 << 10
+)
+
+// defaultBatchHeaders are the headers of a batch request copied to its
+// sub-requests, by default.
+var defaultBatchHeaders = []string{"Authorization", "Cookie", "Accept-Language", "User-Agent"}
+
+// BatchTx is a transaction that the sub-requests of an atomic batch are
+// handled in.
+type BatchTx interface {
+	Commit() error
+	Rollback() error
+}
+
+// BatchOptions configures a batch API.
+type BatchOptions struct {
+	// The maximum number of sub-requests in a batch. Larger batches are
+	// rejected with a 400. Zero means 100.
+	MaxRequests int
+	// The maximum size of the body of a batch request, in bytes. Larger
+	// batches are rejected with a 413. Zero means 1MiB.
+	MaxBodyBytes int64
+	// The maximum size of the body of each sub-request, in bytes. Larger
+	// sub-requests aren't handled, and respond with a 413. Zero means 64KiB.
+	MaxRequestBodyBytes int64
+	// The headers of the batch request that are copied to its sub-requests,
+	// i.e. for authentication. Nil means Authorization, Cookie,
+	// Accept-Language and User-Agent.
+	Headers []string
+	// The maximum number of sub-requests handled at once. Zero means they are
+	// handled one at a time, in order.
+	Concurrency int
+	// Begin starts the transaction of an atomic batch, returning the context
+	// its sub-requests are handled with, which should carry the transaction
+	// for the API's handlers to use. If nil, atomic batches are rejected with
+	// a 400.
+	Begin func(ctx context.Context) (context.Context, BatchTx, error)
+}
+
+// BatchRequest is the body of a request to a batch API.
+type BatchRequest struct {
+	Requests []BatchItem `json:"requests"`
+	// Whether to stop handling sub-requests once one fails, with a 4xx or 5xx.
+	// Sub-requests that aren't handled have a 424 status.
+	StopOnError bool `json:"stop_on_error"`
+	// Whether the sub-requests are handled in a transaction, that is only
+	// committed if they all succeed. Atomic batches stop on the first error,
+	// and are handled one at a time.
+	Atomic bool `json:"atomic"`
+}
+
+// BatchItem is a sub-request of a batch.
+type BatchItem struct {
+	Method string `json:"method"`
+	// The path of the sub-request, which may include a query, i.e.
+	// "/accounts?limit=10".
+	Path string `json:"path"`
+	// Headers added to those of the batch request.
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse is the body of the response to a batch request.
+type BatchResponse struct {
+	// The responses to the sub-requests, in the same order.
+	Responses []BatchItemResponse `json:"responses"`
+	// Whether the transaction of an atomic batch was committed.
+	Committed *bool `json:"committed,omitempty"`
+}
+
+// BatchItemResponse is the response to a sub-request of a batch.
+type BatchItemResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	// The body of the response, as JSON if it is, or as a string otherwise.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// batchAPI handles multiple requests to the API it is served with, in one
+type batchAPI struct {
+	opts BatchOptions
+}
+
+// NewBatchAPI returns an API handling batches of requests, on POST /batch.
+// Each sub-request is routed by the server the batch is sent to, and handled
+// with the middleware and limits of its endpoint, and some headers of the
+// batch request, i.e. for authentication. The server wide middleware only
+// runs for the batch, so each sub-request is made by the principal it
+// authenticated, in its trace. The response holds the status, headers and
+// body of each sub-request's response.
+//
+// It should be combined with the API it batches requests to, see Combine.
+func NewBatchAPI(opts BatchOptions) API {
+	if opts.MaxRequests <= 0 {
+		opts.MaxRequests = defaultMaxBatchRequests
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = defaultMaxBatchBodyBytes
+	}
+	if opts.MaxRequestBodyBytes <= 0 {
+		opts.MaxRequestBodyBytes = defaultMaxBatchRequestBody
+	}
+	if opts.Headers == nil {
+		opts.Headers = defaultBatchHeaders
+	}
+	return &batchAPI{opts: opts}
+}
+
+// Endpoints implements API
+func (a *batchAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method:       http.MethodPost,
+			Path:         "/batch",
+			Handler:      http.HandlerFunc(a.handleBatch),
+			MaxBodyBytes: a.opts.MaxBodyBytes,
+		},
+	}
+}
+
+// handleBatch handles a batch request.
+func (a *batchAPI) handleBatch(w http.ResponseWriter, r *http.Request) {
+	s, ok := r.Context().Value(keyServer).(*server)
+	if !ok {
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if r.Context().Value(keyBatch) != nil {
+		Respond(w, r, http.StatusBadRequest, ErrorBody{Msg: "Batches can't be nested"})
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, ErrBodyTooLarge) {
+			RespondError(w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+		Respond(w, r, http.StatusBadRequest, ErrorBody{Msg: "Invalid batch: " + err.Error()})
+		return
+	}
+	if err := a.validate(&req); err != nil {
+		Respond(w, r, http.StatusBadRequest, ErrorBody{Msg: "Invalid batch: " + err.Error()})
+		return
+	}
+
+	// Sub-requests are made by the same principal, in the same trace, see
+	// withDetails
+	batch := getDetails(r)
+	if batch == nil {
+		batch = &Details{}
+	}
+	ctx := context.WithValue(r.Context(), keyBatch, batch)
+	// Sub-requests aren't written to the connection, so mustn't change its
+	// deadlines
+	ctx = context.WithValue(ctx, keyConn, nil)
+
+	if !req.Atomic {
+		responses := a.dispatch(ctx, s, r, req.Requests, req.StopOnError, a.opts.Concurrency)
+		Respond(w, r, http.StatusOK, BatchResponse{Responses: responses})
+		return
+	}
+
+	ctx, tx, err := a.opts.Begin(ctx)
+	if err != nil {
+		Logger(r.Context()).Errorw("batch transaction failed to begin", "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	responses := a.dispatch(ctx, s, r, req.Requests, true, 1)
+
+	committed := true
+	for _, resp := range responses {
+		if failed(resp.Status) {
+			committed = false
+		}
+	}
+	if committed {
+		if err := tx.Commit(); err != nil {
+			Logger(r.Context()).Errorw("batch transaction failed to commit", "error", err)
+			RespondError(w, r, http.StatusInternalServerError)
+			return
+		}
+	} else if err := tx.Rollback(); err != nil {
+		Logger(r.Context()).Errorw("batch transaction failed to roll back", "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	Respond(w, r, http.StatusOK, BatchResponse{Responses: responses, Committed: &committed})
+}
+
+// validate returns an error if the batch can't be handled, before any of its
+// sub-requests are.
+func (a *batchAPI) validate(req *BatchRequest) error {
+	switch {
+	case len(req.Requests) == 0:
+		return fmt.Errorf("no requests")
+	case len(req.Requests) > a.opts.MaxRequests:
+		return fmt.Errorf("more than %d requests", a.opts.MaxRequests)
+	case req.Atomic && a.opts.Begin == nil:
+		return fmt.Errorf("atomic batches aren't supported")
+	}
+
+	for i, item := range req.Requests {
+		if item.Method == "" {
+			return fmt.Errorf("request %d: missing method", i)
+		}
+		if !strings.HasPrefix(item.Path, "/") {
+			return fmt.Errorf("request %d: path must start with /", i)
+		}
+		if _, err := url.ParseRequestURI(item.Path); err != nil {
+			return fmt.Errorf("request %d: invalid path", i)
+		}
+	}
+	return nil
+}
+
+// dispatch handles the sub-requests of the batch request r with s, at most
+// concurrency at once, returning their responses in order. If stopOnError is
+// set, sub-requests that haven't started when one fails aren't handled, and
+// their responses have a 424 status.
+func (a *batchAPI) dispatch(ctx context.Context, s *server, r *http.Request, items []BatchItem, stopOnError bool, concurrency int) []BatchItemResponse {
+	responses := make([]BatchItemResponse, len(items))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+	)
+	sem := make(chan struct{}, concurrency)
+	for i, item := range items {
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := stopped
+		mu.Unlock()
+		if stop {
+			<-sem
+			responses[i] = BatchItemResponse{Status: http.StatusFailedDependency}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, item BatchItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			responses[i] = a.serveBatchItem(ctx, s, r, item)
+
+			if stopOnError && failed(responses[i].Status) {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+		}(i, item)
+	}
+	wg.Wait()
+
+	return responses
+}
+
+// serveBatchItem handles a sub-request of the batch request r with s, as
+// handleBatchItem does, responding with a 500 if it panics. Sub-requests
+// aren't handled by the goroutine of their connection, so http.Server can't
+// recover them.
+func (a *batchAPI) serveBatchItem(ctx context.Context, s *server, r *http.Request, item BatchItem) (resp BatchItemResponse) {
+	defer func() {
+		if p := recover(); p != nil {
+			Logger(r.Context()).Errorw("batch request panicked", "method", item.Method, "path", item.Path, "panic", p, "stack", string(debug.Stack()))
+			resp = BatchItemResponse{Status: http.StatusInternalServerError}
+		}
+	}()
+	return a.handleBatchItem(ctx, s, r, item)
+}
+
+// handleBatchItem handles a sub-request of the batch request r with s.
+func (a *batchAPI) handleBatchItem(ctx context.Context, s *server, r *http.Request, item BatchItem) BatchItemResponse {
+	if int64(len(item.Body)) > a.opts.MaxRequestBodyBytes {
+		return BatchItemResponse{Status: http.StatusRequestEntityTooLarge}
+	}
+
+	sub, err := http.NewRequest(strings.ToUpper(item.Method), item.Path, bytes.NewReader(item.Body))
+	if err != nil {
+		return BatchItemResponse{Status: http.StatusBadRequest}
+	}
+	sub = sub.WithContext(ctx)
+
+	// The sub-request is made by the same client, over the same connection
+	sub.Host = r.Host
+	sub.RemoteAddr = r.RemoteAddr
+	sub.TLS = r.TLS
+	sub.Proto, sub.ProtoMajor, sub.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+	sub.RequestURI = item.Path
+
+	sub.Header = make(http.Header)
+	for _, k := range a.opts.Headers {
+		if v, ok := r.Header[http.CanonicalHeaderKey(k)]; ok {
+			sub.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+	if len(item.Body) > 0 {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range item.Headers {
+		sub.Header.Set(k, v)
+	}
+
+	bw := batchWriter{header: make(http.Header)}
+	s.batchRouter.ServeHTTP(&bw, sub)
+
+	resp := BatchItemResponse{Status: bw.status, Headers: bw.header}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	if body := bytes.TrimSpace(bw.body.Bytes()); len(body) > 0 {
+		if json.Valid(body) {
+			resp.Body = body
+		} else {
+			resp.Body, _ = json.Marshal(string(body))
+		}
+	}
+	// The body is held in the batch response
+	resp.Headers.Del("Content-Length")
+	resp.Headers.Del("Content-Type")
+	if len(resp.Headers) == 0 {
+		resp.Headers = nil
+	}
+	return resp
+}
+
+// failed returns whether a sub-request with the given status failed.
+func failed(status int) bool {
+	return status >= 400
+}
+
+// batchWriter is a http.ResponseWriter that holds the response to a
+// sub-request of a batch.
+type batchWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header implements http.ResponseWriter
+func (bw *batchWriter) Header() http.Header {
+	return bw.header
+}
+
+// WriteHeader implements http.ResponseWriter
+func (bw *batchWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+// Write implements http.ResponseWriter
+func (bw *batchWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw.body.Write(b)
+}
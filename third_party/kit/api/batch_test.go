@@ -0,0 +1,291 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// batchTx is a BatchTx recording how it finished.
+type batchTx struct {
+	committed, rolledBack bool
+}
+
+// Commit implements BatchTx
+func (tx *batchTx) Commit() error {
+	tx.committed = true
+	return nil
+}
+
+// Rollback implements BatchTx
+func (tx *batchTx) Rollback() error {
+	tx.rolledBack = true
+	return nil
+}
+
+// echoEndpoint responds with the method, headers and body of its requests,
+// failing those with a "fail" query.
+func echoEndpoint(method string) Endpoint {
+	return Endpoint{
+		Method: method,
+		Path:   "/echo",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("fail") != "" {
+				RespondError(w, r, http.StatusBadRequest)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			Respond(w, r, http.StatusOK, map[string]interface{}{"headers": r.Header, "body": string(b)})
+		}),
+	}
+}
+
+// handleBatchTest handles a batch request with the given body, with a server
+// for the batch API and the given endpoints, with a middleware counting the
+// requests it handles, returning the response and the count.
+func handleBatchTest(t *testing.T, opts BatchOptions, body string, header http.Header, endpoints ...Endpoint) (*httptest.ResponseRecorder, BatchResponse, int32) {
+	t.Helper()
+	var count int32
+	counter := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&count, 1)
+			next.ServeHTTP(w, r)
+		})
+	}
+	s := newServer(zap.NewNop().Sugar(), Combine(NewBatchAPI(opts), testAPI(endpoints)), []Middleware{counter})
+
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var resp BatchResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, resp, count
+}
+
+// statuses returns the statuses of the responses to sub-requests.
+func statuses(resp BatchResponse) []int {
+	var s []int
+	for _, r := range resp.Responses {
+		s = append(s, r.Status)
+	}
+	return s
+}
+
+func TestBatch(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Bearer t0k"},
+		"If-Match":      {`"1"`},
+		"Traceparent":   {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+	body := `{"requests": [
+		{"method": "get", "path": "/echo?x=1"},
+		{"method": "POST", "path": "/echo", "headers": {"If-Match": "\"2\""}, "body": {"a": 1}},
+		{"method": "GET", "path": "/missing"}
+	]}`
+	w, resp, count := handleBatchTest(t, BatchOptions{}, body, header, echoEndpoint(http.MethodGet), echoEndpoint(http.MethodPost))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// The server's middleware only runs for the batch
+	if count != 1 {
+		t.Errorf("server middleware ran %d times, want once", count)
+	}
+	if got := statuses(resp); len(got) != 3 || got[0] != 200 || got[1] != 200 || got[2] != 404 {
+		t.Fatalf("statuses = %v, want [200 200 404]", got)
+	}
+	if resp.Responses[0].Headers.Get("X-Method") != http.MethodGet || resp.Responses[0].Headers.Get("Content-Type") != "" {
+		t.Errorf("headers = %v", resp.Responses[0].Headers)
+	}
+
+	var echoes [2]struct {
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}
+	for i := range echoes {
+		if err := json.Unmarshal(resp.Responses[i].Body, &echoes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only some of the batch's headers are copied to its sub-requests
+	if h := echoes[0].Headers; h.Get("Authorization") != "Bearer t0k" || h.Get("If-Match") != "" || h.Get("Traceparent") != "" {
+		t.Errorf("sub-request headers = %v", h)
+	}
+	if h := echoes[1].Headers; h.Get("If-Match") != `"2"` || h.Get("Content-Type") != "application/json" {
+		t.Errorf("sub-request headers = %v", h)
+	}
+	if echoes[1].Body != `{"a": 1}` {
+		t.Errorf("sub-request body = %q", echoes[1].Body)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	opts := BatchOptions{MaxRequests: 2, MaxBodyBytes: 200, MaxRequestBodyBytes: 10}
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		statuses []int
+	}{
+		{name: "too many", body: `{"requests": [{"method": "GET", "path": "/echo"}, {"method": "GET", "path": "/echo"}, {"method": "GET", "path": "/echo"}]}`, status: http.StatusBadRequest},
+		{name: "too large", body: `{"requests": [{"method": "POST", "path": "/echo", "body": "` + strings.Repeat("x", 200) + `"}]}`, status: http.StatusRequestEntityTooLarge},
+		{name: "request too large", body: `{"requests": [{"method": "POST", "path": "/echo", "body": "0123456789"}, {"method": "POST", "path": "/echo", "body": "012345"}]}`, status: http.StatusOK, statuses: []int{413, 200}},
+		{name: "none", body: `{"requests": []}`, status: http.StatusBadRequest},
+		{name: "relative path", body: `{"requests": [{"method": "GET", "path": "echo"}]}`, status: http.StatusBadRequest},
+		{name: "nested", body: `{"requests": [{"method": "POST", "path": "/batch", "body": {"requests": [{"method": "GET", "path": "/echo"}]}}]}`, status: http.StatusOK, statuses: []int{400}},
+		{name: "atomic unsupported", body: `{"atomic": true, "requests": [{"method": "GET", "path": "/echo"}]}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts
+			if tt.name == "nested" {
+				o.MaxRequestBodyBytes = 1000
+			}
+			w, resp, _ := handleBatchTest(t, o, tt.body, nil, echoEndpoint(http.MethodGet), echoEndpoint(http.MethodPost))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := statuses(resp); tt.statuses != nil && !equalInts(got, tt.statuses) {
+				t.Errorf("statuses = %v, want %v", got, tt.statuses)
+			}
+		})
+	}
+}
+
+func TestBatchStopOnError(t *testing.T) {
+	body := `{"stop_on_error": true, "requests": [
+		{"method": "GET", "path": "/echo"},
+		{"method": "GET", "path": "/echo?fail=1"},
+		{"method": "GET", "path": "/echo"}
+	]}`
+	_, resp, _ := handleBatchTest(t, BatchOptions{}, body, nil, echoEndpoint(http.MethodGet))
+	if got := statuses(resp); !equalInts(got, []int{200, 400, 424}) {
+		t.Errorf("statuses = %v, want [200 400 424]", got)
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		var tx batchTx
+		opts := BatchOptions{Begin: func(ctx context.Context) (context.Context, BatchTx, error) {
+			return ctx, &tx, nil
+		}}
+		second := "/echo"
+		if fail {
+			second = "/echo?fail=1"
+		}
+		body := `{"atomic": true, "requests": [{"method": "GET", "path": "/echo"}, {"method": "GET", "path": "` + second + `"}]}`
+		_, resp, _ := handleBatchTest(t, opts, body, nil, echoEndpoint(http.MethodGet))
+
+		if resp.Committed == nil || *resp.Committed == fail || tx.committed == fail || tx.rolledBack != fail {
+			t.Errorf("fail %t: committed = %v, tx = %+v", fail, resp.Committed, tx)
+		}
+	}
+}
+
+func TestBatchPanic(t *testing.T) {
+	panics := func(path string) Endpoint {
+		return Endpoint{
+			Method:  http.MethodGet,
+			Path:    path,
+			Timeout: time.Second,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			}),
+		}
+	}
+	endpoints := testAPI{echoEndpoint(http.MethodGet), panics("/panic")}
+
+	var log testLog
+	s := newServer(log.logger(), Combine(NewBatchAPI(BatchOptions{}), endpoints), nil)
+
+	// A panicking sub-request fails, rather than the process
+	body := `{"stop_on_error": true, "requests": [
+		{"method": "GET", "path": "/echo"},
+		{"method": "GET", "path": "/panic"},
+		{"method": "GET", "path": "/echo"}
+	]}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(resp); !equalInts(got, []int{200, 500, 424}) {
+		t.Errorf("statuses = %v, want [200 500 424]", got)
+	}
+
+	entries := log.entries()
+	if len(entries) != 1 || entries[0].Level != "error" || entries[0].Msg != "batch request panicked" {
+		t.Errorf("logged %+v, want the panic", entries)
+	}
+}
+
+func TestBatchPrincipal(t *testing.T) {
+	// The endpoint requires a principal, and responds with it and the trace
+	whoami := Endpoint{
+		Method: http.MethodGet,
+		Path:   "/whoami",
+		Middlewares: []Middleware{func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if getDetails(r).Principal == "" {
+					RespondError(w, r, http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := getDetails(r)
+			Respond(w, r, http.StatusOK, map[string]string{"principal": d.Principal, "trace": d.TraceID})
+		}),
+	}
+
+	auth := TokenAuthMW(map[string]string{"t0k": "alice"})
+	s := newServer(zap.NewNop().Sugar(), Combine(NewBatchAPI(BatchOptions{Concurrency: 2}), testAPI{whoami}), []Middleware{auth})
+
+	body := `{"requests": [{"method": "GET", "path": "/whoami"}, {"method": "GET", "path": "/whoami"}]}`
+	r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer t0k")
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(resp); !equalInts(got, []int{200, 200}) {
+		t.Fatalf("statuses = %v, want [200 200]", got)
+	}
+
+	// Each sub-request is made by the batch's principal, in its trace
+	for i, item := range resp.Responses {
+		var got map[string]string
+		if err := json.Unmarshal(item.Body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["principal"] != "alice" || got["trace"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("request %d: made by %v, want alice in the batch's trace", i, got)
+		}
+	}
+}
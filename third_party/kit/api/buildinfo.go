@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/ardanlabs/conf"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// BuildInfo describes the build of a service.
+type BuildInfo struct {
+	// The version of the service, i.e. the conf.Version SVN.
+	Version string `json:"version"`
+	// The commit the service was built from.
+	Commit string `json:"commit"`
+	// The version of Go the service was built with.
+	GoVersion string `json:"go_version"`
+}
+
+// NewBuildInfo returns the BuildInfo of the running service, with the given
+// version and commit, i.e. as set at build time using -ldflags.
+func NewBuildInfo(version, commit string) BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// RegisterBuildInfo registers a build_info gauge, with the version, commit and
+// Go version of the given build as labels, to the given registerer. The gauge
+// is always 1, so it can be joined to other metrics.
+func RegisterBuildInfo(reg prometheus.Registerer, b BuildInfo) error {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Build information of the service, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":   b.Version,
+			"commit":    b.Commit,
+			"goversion": b.GoVersion,
+		},
+	})
+	info.Set(1)
+
+	return reg.Register(info)
+}
+
+// versionAPI exposes the build of a service
+type versionAPI struct {
+	build BuildInfo
+}
+
+// NewVersionAPI returns an API exposing the given build as JSON on /version.
+func NewVersionAPI(b BuildInfo) API {
+	return &versionAPI{build: b}
+}
+
+// Endpoints implements API
+func (a *versionAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method: http.MethodGet,
+			Path:   "/version",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Respond(w, r, http.StatusOK, a.build)
+			}),
+		},
+	}
+}
+
+// LogConfig logs the effective configuration of a service, given its conf
+// tagged configuration struct, as returned by conf.String. Fields tagged with
+// noprint, i.e. secrets, are not logged.
+func LogConfig(logger *zap.SugaredLogger, cfg interface{}) error {
+	s, err := conf.String(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Log the fields as an object, so the configuration is searchable. Each
+	// field is printed as "--flag=value".
+	config := make(map[string]string)
+	var last string
+	for _, line := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+		if !strings.HasPrefix(line, "--") {
+			if last == "" {
+				continue
+			}
+			// The value of the last field spans multiple lines
+			config[last] += "\n" + line
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "--"), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		last = kv[0]
+		config[last] = kv[1]
+	}
+
+	logger.Infow("effective configuration", "config", config)
+	return nil
+}
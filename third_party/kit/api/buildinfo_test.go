@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterBuildInfo(t *testing.T) {
+	b := NewBuildInfo("1.2.3", "abc123")
+	if b.GoVersion != runtime.Version() {
+		t.Errorf("go version = %q, want %q", b.GoVersion, runtime.Version())
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := RegisterBuildInfo(reg, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBuildInfo(reg, b); err == nil {
+		t.Error("registering twice succeeded, want error")
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "build_info" || mfs[0].GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("metrics = %v, want build_info of 1", mfs)
+	}
+	labels := make(map[string]string)
+	for _, l := range mfs[0].GetMetric()[0].GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["version"] != "1.2.3" || labels["commit"] != "abc123" || labels["goversion"] != runtime.Version() {
+		t.Errorf("labels = %v", labels)
+	}
+}
+
+func TestVersionAPI(t *testing.T) {
+	b := NewBuildInfo("1.2.3", "abc123")
+	w := handleTest(httptest.NewRequest(http.MethodGet, "/version", nil), NewVersionAPI(b).Endpoints()...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var got BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != b {
+		t.Errorf("version = %+v, want %+v", got, b)
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	cfg := struct {
+		Addr     string `conf:"default:0.0.0.0:8080"`
+		Password string `conf:"noprint"`
+		Web      struct {
+			Timeout int
+		}
+	}{Addr: ":8080", Password: "hunter2"}
+	cfg.Web.Timeout = 5
+
+	var tl testLog
+	if err := LogConfig(tl.logger(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := tl.entries()
+	if len(entries) != 1 || entries[0].Msg != "effective configuration" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	config := entries[0].Config
+	if config["addr"] != ":8080" || config["web-timeout"] != "5" {
+		t.Errorf("config = %v", config)
+	}
+	if _, ok := config["password"]; ok {
+		t.Errorf("config = %v, want noprint fields omitted", config)
+	}
+
+	if err := LogConfig(tl.logger(), cfg); err == nil {
+		t.Error("logging a non-pointer succeeded, want error")
+	}
+}
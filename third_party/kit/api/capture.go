@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// redacted replaces any redacted value in captured bodies.
+const redacted = "[REDACTED]"
+
+// DefaultRedactPatterns match personal data that is always redacted from
+// captured bodies: email addresses, card numbers and IBANs.
+var DefaultRedactPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+	regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`),
+}
+
+// CaptureConfig configures CaptureMW.
+type CaptureConfig struct {
+	// Routes whose bodies are always captured. Routes are given by path, or by
+	// method and path, i.e. "POST /accounts".
+	Routes []string
+	// A header that, when set on a request, causes its bodies to be captured,
+	// i.e. "X-Debug-Capture". Empty means no header is recognised.
+	Header string
+	// The maximum number of bytes of each body captured. Defaults to 4096.
+	MaxBytes int
+	// Paths of JSON values to redact, with keys separated by dots, and "*"
+	// matching any key or array element, i.e. "holder.name" or "*.iban".
+	RedactPaths []string
+	// Patterns to redact from every value, in addition to DefaultRedactPatterns.
+	RedactPatterns []*regexp.Regexp
+}
+
+// CaptureMW returns a middleware that logs the request and response bodies of
+// selected requests, to help debug integrations. Bodies are truncated to
+// MaxBytes, and redacted before they are logged. Bodies that can't be parsed
+// as JSON, i.e. because they were truncated, are only logged if there are no
+// RedactPaths, as they can't be reliably redacted otherwise. Truncated bodies
+// are cut back to the end of their last complete value, so that personal data
+// cut short by the truncation isn't logged unredacted.
+//
+// As any client can set the capture header, CaptureMW should only be used
+// after authentication.
+func CaptureMW(logger *zap.SugaredLogger, cfg CaptureConfig) Middleware {
+	routes := make(map[string]bool)
+	for _, route := range cfg.Routes {
+		routes[strings.TrimSpace(route)] = true
+	}
+
+	max := cfg.MaxBytes
+	if max <= 0 {
+		max = 4096
+	}
+
+	rd := redactor{
+		patterns: append(append([]*regexp.Regexp{}, DefaultRedactPatterns...), cfg.RedactPatterns...),
+	}
+	for _, p := range cfg.RedactPaths {
+		rd.paths = append(rd.paths, strings.Split(p, "."))
+	}
+
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			d := getDetails(r)
+
+			// Decide whether this request is captured
+			capture := cfg.Header != "" && r.Header.Get(cfg.Header) != ""
+			if d != nil && (routes[d.RequestPath] || routes[d.Method+" "+d.RequestPath]) {
+				capture = true
+			}
+			if !capture {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Capture the bodies as they are read and written, without modifying
+			// the request we were given
+			reqBody := captureBuffer{max: max}
+			cr := *r
+			if r.Body != nil {
+				cr.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, &reqBody), r.Body}
+			}
+			cw := captureWriter{ResponseWriter: w, body: captureBuffer{max: max}}
+
+			defer func() {
+				kv := []interface{}{
+					"request_body", rd.redact(reqBody),
+					"response_body", rd.redact(cw.body),
+				}
+				if d != nil {
+					kv = append(detailFields(r.Context(), d), kv...)
+				}
+				logger.Infow("captured request", kv...)
+			}()
+
+			// Call the wrapped handler
+			next.ServeHTTP(&cw, &cr)
+		}
+		return h
+	}
+}
+
+// captureBuffer holds up to max bytes written to it, discarding the rest.
+type captureBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+// Write implements io.Writer. It never fails, so it can't affect the request.
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.buf.Len(); len(p) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// captureWriter is a http.ResponseWriter that captures the body written to it.
+type captureWriter struct {
+	http.ResponseWriter
+	body captureBuffer
+}
+
+// Write implements http.ResponseWriter
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.body.Write(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, if the wrapped http.ResponseWriter does.
+func (cw *captureWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// redactor removes personal data from captured bodies.
+type redactor struct {
+	paths    [][]string
+	patterns []*regexp.Regexp
+}
+
+// redact returns the redacted contents of a captured body.
+func (rd redactor) redact(b captureBuffer) string {
+	if b.buf.Len() == 0 {
+		return ""
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || b.truncated {
+		// We can only redact paths from JSON we can parse
+		if len(rd.paths) > 0 {
+			return "[OMITTED: not complete JSON]"
+		}
+		s := b.buf.String()
+		if b.truncated {
+			s = trimPartialValue(s)
+		}
+		return rd.redactString(s)
+	}
+
+	for _, path := range rd.paths {
+		v = redactPath(v, path)
+	}
+	v = rd.redactValues(v)
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "[OMITTED: not complete JSON]"
+	}
+	return string(out)
+}
+
+// trimPartialValue cuts a truncated body back to the last character that can't
+// be part of the personal data matched by DefaultRedactPatterns, as a value cut
+// short by the truncation may be too short to match its pattern.
+func trimPartialValue(s string) string {
+	i := strings.LastIndexFunc(s, func(r rune) bool {
+		return r >= utf8.RuneSelf || !(r == ' ' || r == '.' || r == '_' || r == '%' || r == '+' || r == '-' || r == '@' ||
+			'0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+	})
+	if i < 0 {
+		return ""
+	}
+	_, n := utf8.DecodeRuneInString(s[i:])
+	return s[:i+n]
+}
+
+// redactPath replaces the values at the given path within v.
+func redactPath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return redacted
+	}
+
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range vv {
+			if path[0] == "*" || path[0] == k {
+				vv[k] = redactPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range vv {
+			if path[0] == "*" {
+				vv[i] = redactPath(child, path[1:])
+			}
+		}
+	}
+
+	return v
+}
+
+// redactValues applies the redaction patterns to every string within v.
+func (rd redactor) redactValues(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range vv {
+			vv[k] = rd.redactValues(child)
+		}
+	case []interface{}:
+		for i, child := range vv {
+			vv[i] = rd.redactValues(child)
+		}
+	case string:
+		return rd.redactString(vv)
+	case json.Number:
+		// Card numbers may be sent as numbers
+		if s := rd.redactString(vv.String()); s != vv.String() {
+			return s
+		}
+	}
+	return v
+}
+
+// redactString applies the redaction patterns to s.
+func (rd redactor) redactString(s string) string {
+	for _, p := range rd.patterns {
+		s = p.ReplaceAllString(s, redacted)
+	}
+	return s
+}
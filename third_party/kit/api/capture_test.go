@@ -0,0 +1,158 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// handleCaptured handles a request with the given header and body, by an
+// endpoint echoing the body, with bodies captured as configured, returning the
+// response and the entries logged.
+func handleCaptured(cfg CaptureConfig, header, body string) (*httptest.ResponseRecorder, []logEntry) {
+	var tl testLog
+	s := newServer(tl.logger(), testAPI{
+		{Method: http.MethodPost, Path: "/echo", Handler: readBody()},
+		{Method: http.MethodPost, Path: "/accounts", Handler: readBody()},
+	}, []Middleware{CaptureMW(tl.logger(), cfg)})
+
+	path := "/echo"
+	if header == "" {
+		path = "/accounts"
+	}
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if header != "" {
+		r.Header.Set(header, "1")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w, tl.entries()
+}
+
+func TestCaptureMW(t *testing.T) {
+	cfg := CaptureConfig{Routes: []string{"POST /accounts"}, Header: "X-Debug-Capture"}
+
+	// Requests that aren't selected aren't captured
+	_, entries := handleCaptured(cfg, "X-Other", `{"a": 1}`)
+	if len(entries) != 0 {
+		t.Errorf("entries = %+v, want none", entries)
+	}
+
+	// Requests with the header, or to the routes, are
+	for _, header := range []string{"X-Debug-Capture", ""} {
+		w, entries := handleCaptured(cfg, header, `{"a": 1}`)
+		if w.Body.String() != `{"a": 1}` {
+			t.Errorf("response = %q, want the body unchanged", w.Body)
+		}
+		if len(entries) != 1 || entries[0].Msg != "captured request" || entries[0].RequestBody != `{"a":1}` || entries[0].ResponseBody != `{"a":1}` || entries[0].RequestID == "" {
+			t.Errorf("header %q: entries = %+v", header, entries)
+		}
+	}
+}
+
+func TestCaptureMWRedaction(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  CaptureConfig
+		body string
+		want string
+	}{
+		{
+			name: "default patterns",
+			body: `{"email": "jo@example.com", "card": "4111 1111 1111 1111", "number": 4111111111111111, "iban": "GB82WEST12345698765432", "amount": 100}`,
+			want: `{"amount":100,"card":"[REDACTED]","email":"[REDACTED]","iban":"[REDACTED]","number":"[REDACTED]"}`,
+		},
+		{
+			name: "paths",
+			cfg:  CaptureConfig{RedactPaths: []string{"holder.name", "accounts.*.sort_code", "*.secret"}},
+			body: `{"holder": {"name": "Jo", "age": 30}, "accounts": [{"sort_code": "12-34-56", "id": 1}], "x": {"secret": "s"}, "name": "kept"}`,
+			want: `{"accounts":[{"id":1,"sort_code":"[REDACTED]"}],"holder":{"age":30,"name":"[REDACTED]"},"name":"kept","x":{"secret":"[REDACTED]"}}`,
+		},
+		{
+			name: "own patterns",
+			cfg:  CaptureConfig{RedactPatterns: []*regexp.Regexp{regexp.MustCompile(`tok_[a-z0-9]+`)}},
+			body: `{"token": "tok_abc123"}`,
+			want: `{"token":"[REDACTED]"}`,
+		},
+		{
+			name: "not JSON",
+			body: `name=jo&email=jo@example.com`,
+			want: `name=jo&email=[REDACTED]`,
+		},
+		{
+			name: "not JSON with paths",
+			cfg:  CaptureConfig{RedactPaths: []string{"name"}},
+			body: `name=jo`,
+			want: `[OMITTED: not complete JSON]`,
+		},
+		{
+			name: "truncated",
+			cfg:  CaptureConfig{MaxBytes: 10, RedactPaths: []string{"name"}},
+			body: `{"name": "jo"}`,
+			want: `[OMITTED: not complete JSON]`,
+		},
+		{
+			name: "truncated without paths",
+			cfg:  CaptureConfig{MaxBytes: 10},
+			body: `{"name": "jo"}`,
+			want: `{"name": "`,
+		},
+		{
+			name: "truncated card number",
+			cfg:  CaptureConfig{MaxBytes: 22},
+			body: `{"card": "4111111111111111"}`,
+			want: `{"card": "`,
+		},
+		{
+			name: "truncated spaced card number",
+			cfg:  CaptureConfig{MaxBytes: 24},
+			body: `{"card": "4111 1111 1111 1111"}`,
+			want: `{"card": "`,
+		},
+		{
+			name: "truncated email",
+			cfg:  CaptureConfig{MaxBytes: 22},
+			body: `{"a": 1, "email": "jo@example.com"}`,
+			want: `{"a": 1, "email": "`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Header = "X-Debug-Capture"
+			w, entries := handleCaptured(tt.cfg, "X-Debug-Capture", tt.body)
+			if w.Body.String() != tt.body {
+				t.Errorf("response = %q, want the body unchanged", w.Body)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("logged %d entries, want 1", len(entries))
+			}
+			if got := entries[0].RequestBody; got != tt.want {
+				t.Errorf("request body = %s, want %s", got, tt.want)
+			}
+			if got := entries[0].ResponseBody; got != tt.want {
+				t.Errorf("response body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptureMWFlush(t *testing.T) {
+	var tl testLog
+	s := newServer(tl.logger(), testAPI{{Method: http.MethodGet, Path: "/stream", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chunk"))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})}}, []Middleware{CaptureMW(tl.logger(), CaptureConfig{Routes: []string{"/stream"}})})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if !w.Flushed {
+		t.Error("response wasn't flushed through the capture")
+	}
+	if entries := tl.entries(); len(entries) != 1 || entries[0].ResponseBody != "chunk" {
+		t.Errorf("entries = %+v, want the streamed body captured", entries)
+	}
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit decides how many requests may be in flight at once.
+// Implementations must be safe for concurrent use.
+type Limit interface {
+	// Limit returns the current maximum number of requests in flight.
+	Limit() int
+	// Observe is called with the latency of every admitted request once it
+	// completes, the number of requests in flight when it was admitted, and
+	// whether it failed because of overload (i.e. it timed out).
+	Observe(latency time.Duration, inflight int, dropped bool)
+}
+
+// staticLimit is a Limit that never changes
+type staticLimit int
+
+// StaticLimit returns a Limit that always allows n requests in flight.
+func StaticLimit(n int) Limit {
+	return staticLimit(n)
+}
+
+// Limit implements Limit
+func (l staticLimit) Limit() int {
+	return int(l)
+}
+
+// Observe implements Limit
+func (l staticLimit) Observe(time.Duration, int, bool) {}
+
+// aimdLimit is a Limit that increases additively while requests are fast, and
+// decreases multiplicatively once they are slow or dropped.
+type aimdLimit struct {
+	mu        sync.Mutex
+	limit     float64
+	min, max  float64
+	threshold time.Duration
+	backoff   float64
+}
+
+// NewAIMDLimit returns a Limit that starts at min, and increases by one for
+// every request faster than threshold that used at least half the limit. When
+// a request is slower than threshold, or dropped, the limit is decreased by
+// 10%. The limit is always kept between min and max. min must be at least
+// one, as a limit of zero admits no requests to observe, so never grows.
+func NewAIMDLimit(min, max int, threshold time.Duration) Limit {
+	checkLimits("NewAIMDLimit", min, max)
+	return &aimdLimit{
+		limit:     float64(min),
+		min:       float64(min),
+		max:       float64(max),
+		threshold: threshold,
+		backoff:   0.9,
+	}
+}
+
+// Limit implements Limit
+func (l *aimdLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Observe implements Limit
+func (l *aimdLimit) Observe(latency time.Duration, inflight int, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case dropped || latency > l.threshold:
+		l.limit = math.Max(l.min, l.limit*l.backoff)
+	case float64(inflight)*2 >= l.limit:
+		// Only increase if we are using the limit, otherwise it grows unbounded
+		// while the service is idle.
+		l.limit = math.Min(l.max, l.limit+1)
+	}
+}
+
+// gradientLimit is a Limit that follows the ratio of the long term latency to
+// the latest latency, so that the limit shrinks as latency grows.
+type gradientLimit struct {
+	mu       sync.Mutex
+	limit    float64
+	min, max float64
+	longRTT  float64
+}
+
+// NewGradientLimit returns a Limit that starts at min, and is adjusted after
+// every request by the gradient of the long term average latency to that
+// request's latency. While latency is stable the limit grows, probing for
+// more capacity. Once latency rises, it shrinks by up to half. The limit is
+// always kept between min and max. min must be at least one, as with
+// NewAIMDLimit.
+func NewGradientLimit(min, max int) Limit {
+	checkLimits("NewGradientLimit", min, max)
+	return &gradientLimit{
+		limit: float64(min),
+		min:   float64(min),
+		max:   float64(max),
+	}
+}
+
+// Limit implements Limit
+func (l *gradientLimit) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Observe implements Limit
+func (l *gradientLimit) Observe(latency time.Duration, inflight int, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rtt := float64(latency)
+	if rtt <= 0 {
+		return
+	}
+
+	// Track the long term latency as an exponential moving average.
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	} else {
+		l.longRTT = l.longRTT*0.99 + rtt*0.01
+	}
+
+	// Don't grow the limit while it isn't being used
+	if !dropped && float64(inflight)*2 < l.limit {
+		return
+	}
+
+	// Tolerate latency up to 1.5x the long term average before shrinking.
+	gradient := math.Max(0.5, math.Min(1, 1.5*l.longRTT/rtt))
+	if dropped {
+		gradient = 0.5
+	}
+
+	// Allow a queue of sqrt(limit) requests, so the limit can grow.
+	next := l.limit*gradient + math.Sqrt(l.limit)
+
+	// Smooth changes, so a single slow request doesn't halve the limit.
+	l.limit = math.Max(l.min, math.Min(l.max, l.limit*0.8+next*0.2))
+}
+
+// checkLimits panics if the bounds given to the named constructor of an
+// adaptive Limit are invalid.
+func checkLimits(name string, min, max int) {
+	if min < 1 || max < min {
+		panic(fmt.Sprintf("api: %s requires 1 <= min <= max, got min %d, max %d", name, min, max))
+	}
+}
+
+// ConcurrencyConfig configures ConcurrencyMW.
+type ConcurrencyConfig struct {
+	// Global limits the requests in flight across all routes. If nil, there
+	// is no global limit.
+	Global Limit
+	// Route returns a new Limit for each route, limiting the requests in
+	// flight to it. If nil, there are no per route limits.
+	Route func() Limit
+	// The fraction of each limit reserved for critical endpoints, i.e. 0.1.
+	// Requests to other endpoints are shed once the rest of the limit is used.
+	CriticalReserve float64
+	// The duration clients are told to wait, via Retry-After, before retrying
+	// a shed request. Rounded up to whole seconds. Defaults to one second.
+	RetryAfter time.Duration
+}
+
+// ConcurrencyMW returns a middleware that limits the number of requests in
+// flight, globally and per route. Excess requests are shed with a 503.
+// It should run after MetricsMW, so that shed requests are still counted.
+func ConcurrencyMW(cfg ConcurrencyConfig) Middleware {
+	retryAfter := "1"
+	if cfg.RetryAfter > 0 {
+		retryAfter = strconv.Itoa(int(math.Ceil(cfg.RetryAfter.Seconds())))
+	}
+
+	global := newLimiter(cfg.Global, cfg.CriticalReserve)
+
+	var mu sync.Mutex
+	routes := make(map[string]*limiter)
+
+	// route returns the limiter for the given route, creating it if necessary.
+	route := func(d *Details) *limiter {
+		if cfg.Route == nil || d == nil {
+			return nil
+		}
+
+		key := d.Method + " " + d.RequestPath
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		l, ok := routes[key]
+		if !ok {
+			l = newLimiter(cfg.Route(), cfg.CriticalReserve)
+			routes[key] = l
+		}
+		return l
+	}
+
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			d := getDetails(r)
+			critical := d != nil && d.Critical
+
+			// Acquire a slot from both the global and route limiters, shedding the
+			// request if either is full.
+			rl := route(d)
+			gi, ok := global.acquire(critical)
+			if !ok {
+				shed(w, r, retryAfter)
+				return
+			}
+			ri, ok := rl.acquire(critical)
+			if !ok {
+				global.release(0, 0, false)
+				shed(w, r, retryAfter)
+				return
+			}
+
+			// Measure latency from the start of the request, as MetricsMW does.
+			start := time.Now()
+			if d != nil {
+				start = d.Now
+			}
+			defer func() {
+				latency := time.Since(start)
+				dropped := d != nil && d.AbortReason == AbortTimeout
+				global.release(latency, gi, dropped)
+				rl.release(latency, ri, dropped)
+			}()
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// shed responds to a request that cannot be admitted.
+func shed(w http.ResponseWriter, r *http.Request, retryAfter string) {
+	w.Header().Set("Retry-After", retryAfter)
+	RespondError(w, r, http.StatusServiceUnavailable)
+}
+
+// limiter tracks the requests in flight against a Limit.
+// A nil limiter admits every request.
+type limiter struct {
+	mu       sync.Mutex
+	limit    Limit
+	reserve  float64
+	inflight int
+}
+
+// newLimiter returns a limiter for the given Limit, or nil if there is none.
+func newLimiter(l Limit, reserve float64) *limiter {
+	if l == nil {
+		return nil
+	}
+	return &limiter{limit: l, reserve: reserve}
+}
+
+// acquire admits a request if there is space for it under the limit,
+// returning the number of requests in flight when it was admitted.
+func (l *limiter) acquire(critical bool) (int, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Non-critical requests can't use the reserved part of the limit.
+	max := float64(l.limit.Limit())
+	if !critical {
+		max = max * (1 - l.reserve)
+	}
+	if float64(l.inflight) >= max {
+		return 0, false
+	}
+
+	l.inflight++
+	return l.inflight, true
+}
+
+// release removes an admitted request from those in flight. If it completed,
+// its latency is observed by the Limit.
+func (l *limiter) release(latency time.Duration, inflight int, dropped bool) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+
+	if inflight > 0 {
+		l.limit.Observe(latency, inflight, dropped)
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAdaptiveLimitBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+	}{
+		{name: "zero min", min: 0, max: 10},
+		{name: "negative min", min: -1, max: 10},
+		{name: "max below min", min: 10, max: 5},
+	}
+	for _, tt := range tests {
+		for name, fn := range map[string]func(){
+			"aimd":     func() { NewAIMDLimit(tt.min, tt.max, time.Second) },
+			"gradient": func() { NewGradientLimit(tt.min, tt.max) },
+		} {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				defer func() {
+					if recover() == nil {
+						t.Error("invalid bounds didn't panic")
+					}
+				}()
+				fn()
+			})
+		}
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := NewAIMDLimit(1, 4, 100*time.Millisecond)
+	if got := l.Limit(); got != 1 {
+		t.Fatalf("limit = %d, want to start at min 1", got)
+	}
+
+	// Fast requests using the limit grow it, up to max
+	for i := 0; i < 10; i++ {
+		l.Observe(time.Millisecond, l.Limit(), false)
+	}
+	if got := l.Limit(); got != 4 {
+		t.Errorf("limit = %d, want max 4", got)
+	}
+
+	// Fast requests that don't use the limit don't grow it
+	l = NewAIMDLimit(2, 10, 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		l.Observe(time.Millisecond, 0, false)
+	}
+	if got := l.Limit(); got != 2 {
+		t.Errorf("idle limit = %d, want 2", got)
+	}
+
+	// Slow or dropped requests shrink it, down to min
+	l = NewAIMDLimit(2, 10, 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		l.Observe(time.Millisecond, 10, false)
+	}
+	l.Observe(time.Second, 10, false)
+	if got := l.Limit(); got != 9 {
+		t.Errorf("limit = %d, want 9 after a slow request", got)
+	}
+	for i := 0; i < 50; i++ {
+		l.Observe(time.Millisecond, 10, true)
+	}
+	if got := l.Limit(); got != 2 {
+		t.Errorf("limit = %d, want min 2", got)
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	l := NewGradientLimit(1, 20)
+
+	// Stable latency grows the limit, up to max
+	for i := 0; i < 200; i++ {
+		l.Observe(10*time.Millisecond, l.Limit(), false)
+	}
+	if got := l.Limit(); got != 20 {
+		t.Errorf("limit = %d, want max 20", got)
+	}
+
+	// Dropped requests shrink it, down to the queue it allows
+	for i := 0; i < 200; i++ {
+		l.Observe(time.Second, l.Limit(), true)
+	}
+	if got := l.Limit(); got > 4 {
+		t.Errorf("limit = %d, want at most 4", got)
+	}
+
+	// Never below min
+	l = NewGradientLimit(8, 20)
+	for i := 0; i < 200; i++ {
+		l.Observe(time.Second, l.Limit(), true)
+	}
+	if got := l.Limit(); got != 8 {
+		t.Errorf("limit = %d, want min 8", got)
+	}
+}
+
+// handleConcurrent serves requests to the given paths, each once the previous
+// is in flight or shed, while the handler blocks, returning their statuses.
+func handleConcurrent(t *testing.T, cfg ConcurrencyConfig, paths ...string) []int {
+	t.Helper()
+	var handled sync.WaitGroup
+	release := make(chan struct{})
+	block := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled.Done()
+		<-release
+	})
+	s := newServer(zap.NewNop().Sugar(), testAPI{
+		{Method: http.MethodGet, Path: "/a", Handler: block},
+		{Method: http.MethodGet, Path: "/b", Handler: block},
+		{Method: http.MethodGet, Path: "/critical", Handler: block, Critical: true},
+	}, []Middleware{ConcurrencyMW(cfg)})
+
+	statuses := make([]int, len(paths))
+	var done sync.WaitGroup
+	for i, path := range paths {
+		handled.Add(1)
+		done.Add(1)
+		go func(i int, path string) {
+			defer done.Done()
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			statuses[i] = w.Code
+			if w.Code == http.StatusServiceUnavailable {
+				if w.Header().Get("Retry-After") != "1" {
+					t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+				}
+				handled.Done()
+			}
+		}(i, path)
+		handled.Wait()
+	}
+
+	close(release)
+	done.Wait()
+	return statuses
+}
+
+func TestConcurrencyMW(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   ConcurrencyConfig
+		paths []string
+		want  []int
+	}{
+		{name: "no limits", cfg: ConcurrencyConfig{}, paths: []string{"/a", "/a", "/a"}, want: []int{200, 200, 200}},
+		{name: "global", cfg: ConcurrencyConfig{Global: StaticLimit(2)}, paths: []string{"/a", "/b", "/a"}, want: []int{200, 200, 503}},
+		{name: "route", cfg: ConcurrencyConfig{Route: func() Limit { return StaticLimit(1) }}, paths: []string{"/a", "/b", "/a"}, want: []int{200, 200, 503}},
+		{name: "reserve", cfg: ConcurrencyConfig{Global: StaticLimit(2), CriticalReserve: 0.5}, paths: []string{"/a", "/b", "/critical"}, want: []int{200, 503, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handleConcurrent(t, tt.cfg, tt.paths...)
+			if !equalInts(got, tt.want) {
+				t.Errorf("statuses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// equalInts returns whether a and b are equal.
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ServerConfig is the standard configuration of a server. Its fields are
+// tagged to be parsed by conf, so it can be embedded in the configuration of
+// a service, and passed to NewServerFromConfig. Fields that can't change once
+// the server is running are tagged to be reported by ConfigReloader.
+type ServerConfig struct {
+	// The address to serve the API on, in any form accepted by Listen, i.e. a
+	// Unix socket or a listener passed by systemd.
+	Addr string `conf:"default:0.0.0.0:8080,help:address to serve the API on i.e. :8080 or unix:/path or systemd" reload:"restart"`
+	// The mode of the socket, if serving on a Unix socket.
+	SocketMode os.FileMode `conf:"default:0660,help:permissions of the Unix socket if serving on one" reload:"restart"`
+	// Whether to serve HTTP/2 without TLS, alongside HTTP/1.
+	H2C bool `conf:"help:serve HTTP/2 without TLS" reload:"restart"`
+	// The address to serve internal endpoints, i.e. NewDebugAPI, on. See
+	// NewAdminServerFromConfig.
+	AdminAddr string `conf:"default:0.0.0.0:9090,help:address to serve metrics and debug endpoints on" reload:"restart"`
+	// The maximum duration for reading a request, including its body.
+	ReadTimeout time.Duration `conf:"default:5s,help:maximum duration for reading a request" reload:"restart"`
+	// The maximum duration for reading the headers of a request.
+	ReadHeaderTimeout time.Duration `conf:"default:2s,help:maximum duration for reading request headers" reload:"restart"`
+	// The maximum duration for writing a response.
+	WriteTimeout time.Duration `conf:"default:10s,help:maximum duration for writing a response" reload:"restart"`
+	// The maximum duration to wait for the next request on a keep-alive connection.
+	IdleTimeout time.Duration `conf:"default:120s,help:maximum duration to keep idle connections open" reload:"restart"`
+	// The maximum size of request headers, in bytes.
+	MaxHeaderBytes int `conf:"default:1048576,help:maximum size of request headers in bytes" reload:"restart"`
+	// The maximum number of connections open at once. Further connections
+	// are rejected with a 503. Zero means no limit. The limit is only applied
+	// when the server is served by ServerConfig.ListenAndServe, not by the
+	// ListenAndServe or Serve methods of http.Server.
+	MaxConns int `conf:"default:0,help:maximum number of open connections, 0 is no limit" reload:"restart"`
+	// How long in-flight requests are given to finish when shutting down. See
+	// Shutdown.
+	ShutdownGrace time.Duration `conf:"default:20s,help:duration in-flight requests are given to finish on shutdown"`
+	// The paths of the certificate and key to serve TLS with. TLS is only
+	// served if both are set.
+	TLSCertFile string `conf:"help:path of the TLS certificate, TLS is served if set" reload:"restart"`
+	TLSKeyFile  string `conf:"help:path of the TLS private key" reload:"restart"`
+	// The path of a bundle of CAs that clients must present a certificate
+	// signed by. Client certificates are only required if set.
+	TLSClientCAFile string `conf:"help:path of the CA bundle to verify client certificates with" reload:"restart"`
+	// The level and format of logs, as given to NewLogger. See
+	// ServerConfig.NewLogger.
+	LogLevel  string `conf:"default:info,help:minimum level of logs i.e. debug or info"`
+	LogFormat string `conf:"default:json,help:format of logs i.e. json console or gcp" reload:"restart"`
+	// Whether to log requests as Cloud Logging access logs, and the version of
+	// the API to label them with, see ServerOptions.
+	AccessLog  bool   `conf:"help:log requests as Cloud Logging access logs" reload:"restart"`
+	APIVersion string `conf:"help:version of the API to label access logs with i.e. v1" reload:"restart"`
+	// The Google Cloud project traces are recorded in, used to correlate logs
+	// with traces, see ServerOptions.
+	TraceProject string `conf:"help:Google Cloud project traces are recorded in" reload:"restart"`
+}
+
+// TLS returns whether the server should serve TLS.
+func (c ServerConfig) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// NewLogger returns a logger with the configured level and format, as
+// NewLogger does.
+func (c ServerConfig) NewLogger() (*zap.SugaredLogger, *LogLevels, error) {
+	return NewLogger(c.LogLevel, c.LogFormat)
+}
+
+// ListenAndServe starts the given server on the configured address, serving
+// TLS with the configured certificate and key, if set. The TLS files are
+// reloaded when they change, with failures logged to the given logger, see
+// NewTLSConfig.
+func (c ServerConfig) ListenAndServe(logger *zap.SugaredLogger, s *http.Server) error {
+	if c.H2C {
+		if err := enableH2C(s); err != nil {
+			return err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if c.TLS() {
+		var err error
+		if tlsConfig, err = NewTLSConfig(logger, c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	l, err := Listen(c.Addr, c.SocketMode)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		s.TLSConfig = tlsConfig
+	}
+	return serve(s, l)
+}
+
+// NewServerFromConfig returns a HTTP server for accessing the given API, as
+// NewServer does, listening on the configured address, with the configured
+// timeouts and limits, and logging requests as configured. It should be served
+// by ServerConfig.ListenAndServe, which also applies the configured TLS and
+// connection limit.
+func NewServerFromConfig(cfg ServerConfig, logger *zap.SugaredLogger, a API) http.Server {
+	opts := ServerOptions{AccessLog: cfg.AccessLog, APIVersion: cfg.APIVersion, TraceProject: cfg.TraceProject}
+	return *cfg.withTimeouts(newHTTPServer(cfg.Addr, logger, a, opts, cfg.MaxConns))
+}
+
+// withTimeouts sets the configured timeouts and limits on the given server,
+// returning it.
+func (c ServerConfig) withTimeouts(s *http.Server) *http.Server {
+	s.ReadTimeout = c.ReadTimeout
+	s.ReadHeaderTimeout = c.ReadHeaderTimeout
+	s.WriteTimeout = c.WriteTimeout
+	s.IdleTimeout = c.IdleTimeout
+	s.MaxHeaderBytes = c.MaxHeaderBytes
+	return s
+}
+
+// NewAdminServerFromConfig returns a HTTP server for accessing the given
+// internal API, i.e. NewDebugAPI, listening on the configured admin address.
+// Its requests are neither logged nor measured, and responses have no write
+// timeout, so that profiles can be streamed for as long as they are asked for.
+func NewAdminServerFromConfig(cfg ServerConfig, logger *zap.SugaredLogger, a API) http.Server {
+	return http.Server{
+		Addr:              cfg.AdminAddr,
+		Handler:           newServer(logger, a, nil),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// Shutdown gracefully shuts down the given servers, as http.Server.Shutdown
+// does, giving in-flight requests the configured grace to finish. Servers that
+// haven't finished by then are closed. The first error encountered is
+// returned.
+func (c ServerConfig) Shutdown(servers ...*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownGrace)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			err := s.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				s.Close()
+			}
+			errs <- err
+		}(s)
+	}
+
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestServerConfigNewLogger(t *testing.T) {
+	cfg := ServerConfig{LogLevel: "warn", LogFormat: "json"}
+	logger, levels, err := cfg.NewLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger == nil || levels.Levels()[0].Level != "warn" {
+		t.Errorf("levels = %+v, want warn", levels.Levels())
+	}
+
+	cfg.LogFormat = "xml"
+	if _, _, err := cfg.NewLogger(); err == nil {
+		t.Error("invalid format succeeded, want error")
+	}
+}
+
+func TestNewAdminServerFromConfig(t *testing.T) {
+	cfg := ServerConfig{AdminAddr: "127.0.0.1:9090", ReadTimeout: time.Second, WriteTimeout: time.Second}
+	s := NewAdminServerFromConfig(cfg, zap.NewNop().Sugar(), testAPI{
+		{Method: http.MethodGet, Path: "/version", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Respond(w, r, http.StatusOK, "v1")
+		})},
+	})
+
+	if s.Addr != cfg.AdminAddr || s.ReadTimeout != cfg.ReadTimeout || s.WriteTimeout != 0 {
+		t.Errorf("server addr = %q, timeouts = %s, %s", s.Addr, s.ReadTimeout, s.WriteTimeout)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServerConfigShutdown(t *testing.T) {
+	// Serve a request that only finishes once released
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})}
+	idle := &http.Server{Handler: http.NotFoundHandler()}
+
+	for _, s := range []*http.Server{s, idle} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go s.Serve(l)
+		s.Addr = l.Addr().String()
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + s.Addr)
+		errs <- err
+	}()
+	<-started
+
+	cfg := ServerConfig{ShutdownGrace: 50 * time.Millisecond}
+	start := time.Now()
+	if err := cfg.Shutdown(s, idle); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took < cfg.ShutdownGrace || took > time.Second {
+		t.Errorf("Shutdown() took %s, want the grace of %s", took, cfg.ShutdownGrace)
+	}
+
+	// The in-flight request was cut off once the grace ran out
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("request succeeded, want it closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("request still in-flight after shutdown")
+	}
+}
+
+func TestNewServerFromConfig(t *testing.T) {
+	// The server registers its metrics globally, so give it a registry of its own
+	defer func(reg prometheus.Registerer) {
+		prometheus.DefaultRegisterer = reg
+	}(prometheus.DefaultRegisterer)
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	var tl testLog
+	cfg := ServerConfig{Addr: ":8080", ReadTimeout: time.Second, WriteTimeout: 2 * time.Second, MaxHeaderBytes: 1 << 10, MaxConns: 10, AccessLog: true, APIVersion: "v1", TraceProject: "my-project"}
+	s := NewServerFromConfig(cfg, tl.logger(), testAPI{statusEndpoint})
+
+	if s.Addr != cfg.Addr || s.ReadTimeout != cfg.ReadTimeout || s.WriteTimeout != cfg.WriteTimeout || s.MaxHeaderBytes != cfg.MaxHeaderBytes {
+		t.Errorf("server addr = %q, timeouts = %s, %s", s.Addr, s.ReadTimeout, s.WriteTimeout)
+	}
+	if srv, ok := s.Handler.(*server); !ok || srv.conns.max != cfg.MaxConns || srv.traceProject != cfg.TraceProject {
+		t.Errorf("handler = %T, want a server limited to %d connections", s.Handler, cfg.MaxConns)
+	}
+
+	// Requests are logged as configured
+	r := httptest.NewRequest(http.MethodGet, "/status/404", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	if entries := tl.entries(); len(entries) != 1 || entries[0].Level != "warn" || entries[0].HTTPRequest == nil || entries[0].Trace == "" {
+		t.Errorf("entries = %+v, want one access log", entries)
+	}
+}
@@ -0,0 +1,408 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ardanlabs/conf"
+	"gopkg.in/yaml.v3"
+)
+
+// FileSource is a conf.Sourcer of values from a JSON, YAML or TOML file.
+type FileSource struct {
+	path string
+	// values maps normalized keys, see configKey, to values as conf parses them.
+	values map[string]string
+}
+
+// NewFileSource returns a FileSource of the values in the file at path, which
+// is parsed as JSON, YAML or TOML by its extension, one of .json, .yaml, .yml
+// or .toml.
+//
+// Nested keys in the file map to the fields of nested structs, matching the
+// names conf derives for environment variables, ignoring case, and whether
+// words are separated by case, dashes or underscores. For example, the field
+// ReadTimeout of a struct in the field Server can be set by any of:
+//
+//	{"server": {"read_timeout": "5s"}}
+//	{"server": {"readTimeout": "5s"}}
+//	{"Server": {"read-timeout": "5s"}}
+//
+// Arrays of scalars are given to slice fields, and objects of scalars to map
+// fields, in the formats conf expects for them.
+func NewFileSource(path string) (*FileSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := decodeConfigFile(filepath.Ext(path), data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	s := FileSource{
+		path:   path,
+		values: make(map[string]string),
+	}
+	if err := s.flatten("", "", m); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return &s, nil
+}
+
+// decodeConfigFile decodes the data of a config file, in the format named by
+// its extension.
+func decodeConfigFile(ext string, data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	switch strings.ToLower(ext) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			// An empty file
+			return map[string]interface{}{}, nil
+		}
+		var ok bool
+		if m, ok = yamlValue(v).(map[string]interface{}); !ok {
+			return nil, errors.New("must hold a mapping")
+		}
+	case ".toml":
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q, use .json, .yaml, .yml or .toml", ext)
+	}
+	return m, nil
+}
+
+// yamlValue returns a value decoded from YAML with its mappings keyed by
+// strings, as they are when decoded from JSON or TOML.
+func yamlValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, item := range vv {
+			m[fmt.Sprint(k)] = yamlValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range vv {
+			vv[i] = yamlValue(item)
+		}
+	}
+	return v
+}
+
+// flatten adds the values of m, with keys prefixed by prefix, to the source.
+// Arrays that hold anything but scalars can't be given to a field, so are
+// rejected, naming them by their path in the file.
+func (s *FileSource) flatten(path, prefix string, m map[string]interface{}) error {
+	var pairs []string
+	for k, v := range m {
+		key := configKey(prefix, k)
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if err := s.flatten(path+k+".", key, vv); err != nil {
+				return err
+			}
+		case []map[string]interface{}:
+			// A TOML array of tables
+			return fmt.Errorf("%s%s: arrays may only hold strings, numbers and booleans", path, k)
+		case []interface{}:
+			items := make([]string, 0, len(vv))
+			for _, item := range vv {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return fmt.Errorf("%s%s: arrays may only hold strings, numbers and booleans", path, k)
+				}
+				items = append(items, configValue(item))
+			}
+			s.values[key] = strings.Join(items, ";")
+		default:
+			s.values[key] = configValue(vv)
+			pairs = append(pairs, k+":"+s.values[key])
+		}
+	}
+
+	// An object of scalars may also be the value of a map field
+	if prefix != "" && len(pairs) > 0 {
+		sort.Strings(pairs)
+		if _, ok := s.values[prefix]; !ok {
+			s.values[prefix] = strings.Join(pairs, ";")
+		}
+	}
+	return nil
+}
+
+// Path returns the path of the file.
+func (s *FileSource) Path() string {
+	return s.path
+}
+
+// Source implements conf.Sourcer
+func (s *FileSource) Source(fld conf.Field) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	v, ok := s.values[configKey(fld.FlagKey...)]
+	return v, ok
+}
+
+// configKey normalizes the parts of a key, so keys match whatever their case or
+// separators. Each part is split into words, by dashes, underscores and camel
+// case, as conf splits field names, and the words of every part are joined by
+// underscores, as conf names environment variables. For example, the parts
+// "server" and "readTimeout" are "server_read_timeout".
+func configKey(parts ...string) string {
+	var words []string
+	for _, part := range parts {
+		for _, w := range strings.FieldsFunc(part, func(r rune) bool { return r == '-' || r == '_' }) {
+			words = append(words, camelWords(w)...)
+		}
+	}
+	return strings.ToLower(strings.Join(words, "_"))
+}
+
+// camelWords splits a camel case name into its words, as conf does for the
+// names of fields. For example, "ReadTimeout" is "Read" and "Timeout", and
+// "HTTPAddr" is "HTTP" and "Addr".
+func camelWords(s string) []string {
+	class := func(r rune) int {
+		switch {
+		case unicode.IsLower(r):
+			return 0
+		case unicode.IsUpper(r):
+			return 1
+		case unicode.IsDigit(r):
+			return 2
+		}
+		return 3
+	}
+
+	runes := []rune(s)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		prev, cur := class(runes[i-1]), class(runes[i])
+		switch {
+		case prev == cur:
+		case prev == 1 && cur != 2:
+			// The last upper case letter starts the next word, i.e. the A of
+			// HTTPAddr
+			if i-1 > start {
+				words = append(words, string(runes[start:i-1]))
+				start = i - 1
+			}
+		default:
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// configValue returns the string value of a scalar decoded from a file.
+func configValue(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		// A TOML or YAML timestamp, in the format conf parses
+		return vv.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// The origins of configuration values.
+const (
+	OriginFlag    = "flag"
+	OriginEnv     = "env"
+	OriginFile    = "file"
+	OriginDefault = "default"
+	OriginUnset   = "unset"
+)
+
+// ConfigOrigin describes where the value of a configuration field came from.
+type ConfigOrigin struct {
+	// The flag of the field, i.e. "--server-addr".
+	Flag string
+	// The environment variable of the field, i.e. "$ACCOUNTS_SERVER_ADDR".
+	Env string
+	// Where the value came from, one of the Origin constants.
+	Origin string
+	// The value of the field, empty if the field is noprint.
+	Value string
+	// Whether the field is tagged noprint, or is a Secret.
+	Noprint bool
+}
+
+// ConfigOrigins describes where the values of a configuration came from.
+type ConfigOrigins []ConfigOrigin
+
+// String returns a table of every field, with its value and origin.
+func (o ConfigOrigins) String() string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	for _, co := range o {
+		value := co.Value
+		if co.Noprint {
+			value = "<noprint>"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", co.Flag, value, co.Origin)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+// Usage returns the usage of the configuration, as conf.Usage does, followed by
+// the current value of each field and where it came from.
+func (o ConfigOrigins) Usage(namespace string, cfg interface{}) (string, error) {
+	usage, err := conf.Usage(namespace, cfg)
+	if err != nil {
+		return "", err
+	}
+	return usage + "\nVALUES\n" + o.String(), nil
+}
+
+// ParseConfig parses configuration into cfg, as conf.Parse does, also taking
+// values from the configuration file at path, if it isn't empty, see
+// NewFileSource. Values are taken from flags, then the environment, then the
+// file, then defaults. The returned ConfigOrigins describe where each value
+// came from.
+//
+// If help is requested, conf.ErrHelpWanted is returned alongside the origins
+// of the values that would otherwise have been parsed, so they can be shown
+// with ConfigOrigins.Usage.
+func ParseConfig(args []string, namespace, path string, cfg interface{}) (ConfigOrigins, error) {
+	var file *FileSource
+	if path != "" {
+		var err error
+		if file, err = NewFileSource(path); err != nil {
+			return nil, err
+		}
+	}
+
+	rec := fieldRecorder{}
+	err := conf.Parse(args, namespace, cfg, file, &rec)
+	if err == conf.ErrHelpWanted {
+		// Parse without the help flag, so the values can be shown with the usage
+		rec = fieldRecorder{}
+		if err := conf.Parse(withoutHelp(args), namespace, cfg, file, &rec); err != nil {
+			return nil, conf.ErrHelpWanted
+		}
+		return configOrigins(args, namespace, file, rec), conf.ErrHelpWanted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return configOrigins(args, namespace, file, rec), nil
+}
+
+// configOrigins returns the origins of the values of the recorded fields.
+func configOrigins(args []string, namespace string, file *FileSource, rec fieldRecorder) ConfigOrigins {
+	flags := flagNames(args)
+
+	var origins ConfigOrigins
+	for _, fld := range rec {
+		flag := strings.ToLower(strings.Join(fld.FlagKey, "-"))
+		env := strings.ToUpper(namespace + "_" + strings.Join(fld.EnvKey, "_"))
+
+		co := ConfigOrigin{
+			Flag:    "--" + flag,
+			Env:     "$" + env,
+			Origin:  OriginUnset,
+			Noprint: fld.Options.Noprint || fld.Field.Type() == secretType,
+		}
+		if !co.Noprint {
+			co.Value = fmt.Sprintf("%v", fld.Field.Interface())
+		}
+
+		_, inFile := file.Source(fld)
+		_, inEnv := os.LookupEnv(env)
+		switch {
+		case flags[flag] || (fld.Options.ShortFlagChar != 0 && flags[string(fld.Options.ShortFlagChar)]):
+			co.Origin = OriginFlag
+		case inEnv:
+			co.Origin = OriginEnv
+		case inFile:
+			co.Origin = OriginFile
+		case fld.Options.DefaultVal != "":
+			co.Origin = OriginDefault
+		}
+
+		origins = append(origins, co)
+	}
+
+	return origins
+}
+
+// fieldRecorder is a conf.Sourcer that provides no values, but records the
+// fields it is asked for, so they can be inspected after parsing.
+type fieldRecorder []conf.Field
+
+// Source implements conf.Sourcer
+func (r *fieldRecorder) Source(fld conf.Field) (string, bool) {
+	// Version fields aren't configuration
+	if fld.Name != "SVN" && fld.Name != "Desc" {
+		*r = append(*r, fld)
+	}
+	return "", false
+}
+
+// flagNames returns the names of the flags given in args, as conf parses them.
+func flagNames(args []string) map[string]bool {
+	names := make(map[string]bool)
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			// The value of the previous flag
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if i := strings.Index(name, "="); i > 0 {
+			name = name[:i]
+		}
+		names[strings.ToLower(name)] = true
+	}
+	return names
+}
+
+// withoutHelp returns args without any help flag.
+func withoutHelp(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		switch strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0] {
+		case "help", "h", "?":
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+		}
+		out = append(out, arg)
+	}
+	return out
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file in dir, returning its path.
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fileConfig is a configuration set from a file
+type fileConfig struct {
+	Name   string
+	Server struct {
+		ReadTimeout time.Duration
+		MaxConns    int
+	}
+	Hosts  []string
+	Limits map[string]int
+	Debug  bool
+	Note   string `conf:"default:none"`
+}
+
+func TestParseConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The same configuration, in every supported format
+	files := map[string]string{
+		"config.json": `{
+			"name": "O'Brien # the name",
+			"server": {"read_timeout": "5s", "MaxConns": 12345678901},
+			"hosts": ["a", "b#c"],
+			"limits": {"x": 1, "y": 2},
+			"debug": true
+		}`,
+		"config.yaml": `
+name: "O'Brien # the name" # a comment
+server:
+  readTimeout: 5s
+  max-conns: 12345678901
+hosts: [a, "b#c"]
+limits:
+  x: 1
+  y: 2
+debug: true
+`,
+		"config.toml": `
+name = "O'Brien # the name" # a comment
+hosts = ["a", "b#c"]
+debug = true
+
+[server]
+read_timeout = "5s"
+MaxConns = 12345678901
+
+[limits]
+x = 1
+y = 2
+`,
+	}
+
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, dir, name, data)
+
+			var cfg fileConfig
+			origins, err := ParseConfig([]string{"--debug=false"}, "TEST", path, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := fileConfig{
+				Name:   "O'Brien # the name",
+				Hosts:  []string{"a", "b#c"},
+				Limits: map[string]int{"x": 1, "y": 2},
+				Note:   "none",
+			}
+			want.Server.ReadTimeout = 5 * time.Second
+			want.Server.MaxConns = 12345678901
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("config = %+v, want %+v", cfg, want)
+			}
+
+			got := make(map[string]string)
+			for _, o := range origins {
+				got[o.Flag] = o.Origin
+			}
+			for flag, origin := range map[string]string{
+				"--name":                OriginFile,
+				"--server-read-timeout": OriginFile,
+				"--debug":               OriginFlag,
+				"--note":                OriginDefault,
+			} {
+				if got[flag] != origin {
+					t.Errorf("origin of %s = %q, want %q", flag, got[flag], origin)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigFileNesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Keys only match fields nested in the same way
+	var cfg struct {
+		A struct {
+			Bc int
+		}
+		Ab struct {
+			C int
+		}
+	}
+	path := writeFile(t, dir, "config.json", `{"a": {"bc": 1}}`)
+	if _, err := ParseConfig(nil, "TEST", path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.A.Bc != 1 || cfg.Ab.C != 0 {
+		t.Errorf("a.bc set A.Bc to %d and Ab.C to %d, want 1 and 0", cfg.A.Bc, cfg.Ab.C)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "config.ini", data: "name = x", err: `unsupported format ".ini"`},
+		{name: "config.json", data: `{"name": `, err: "config.json"},
+		{name: "config.json", data: `["name"]`, err: "config.json"},
+		{name: "config.json", data: `{"server": {"hosts": [{"a": 1}]}}`, err: "server.hosts: arrays may only hold"},
+		{name: "config.json", data: `{"hosts": [["a"]]}`, err: "hosts: arrays may only hold"},
+		{name: "config.yaml", data: "- name", err: "must hold a mapping"},
+		{name: "config.yaml", data: "name: [", err: "config.yaml"},
+		{name: "config.toml", data: "[[hosts]]\na = 1", err: "hosts: arrays may only hold"},
+		{name: "config.toml", data: "name = ", err: "config.toml"},
+	}
+	for _, tt := range tests {
+		path := writeFile(t, dir, tt.name, tt.data)
+		var cfg fileConfig
+		_, err := ParseConfig(nil, "TEST", path, &cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want it to contain %q", tt.data, err, tt.err)
+		}
+	}
+
+	if _, err := NewFileSource(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file: succeeded, want an error")
+	}
+}
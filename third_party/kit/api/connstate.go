@@ -0,0 +1,232 @@
+package api
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connRejectBody is the body of the response to connections rejected because
+// the server is at its connection limit.
+const connRejectBody = `{"msg":"Service Unavailable"}`
+
+// connRejectResponse is the response to connections rejected because the
+// server is at its connection limit.
+var connRejectResponse = []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+	"Connection: close\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: " + strconv.Itoa(len(connRejectBody)) + "\r\n" +
+	"Retry-After: 1\r\n" +
+	"\r\n" +
+	connRejectBody)
+
+// maxRejecting is the most rejected connections responded to at once, see
+// rejectConn. Beyond it, rejected connections are closed without a response,
+// so that a flood of connections can't start unbounded goroutines and TLS
+// handshakes.
+const maxRejecting = 64
+
+// connTracker tracks the connections of a server, using its ConnState hook,
+// exporting metrics of them. It also limits how many connections may be open
+// at once, by wrapping the server's listener.
+type connTracker struct {
+	// open is the number of connections open, accessed atomically. It is first
+	// so it is 64-bit aligned.
+	open int64
+	max  int
+
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+
+	// rejecting holds a token for each rejected connection being responded to
+	rejecting chan struct{}
+
+	current  *prometheus.GaugeVec
+	opened   prometheus.Counter
+	closed   prometheus.Counter
+	hijacked prometheus.Counter
+	rejected prometheus.Counter
+}
+
+// newConnTracker returns a connTracker, registering its metrics with the given
+// registerer, with the given labels added to every metric. If max is
+// positive, connections beyond max are rejected with a 503, see limit.
+func newConnTracker(reg prometheus.Registerer, labels prometheus.Labels, max int) *connTracker {
+	t := connTracker{
+		max:       max,
+		states:    make(map[net.Conn]http.ConnState),
+		rejecting: make(chan struct{}, maxRejecting),
+		current: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "api_http_connections",
+			Help:        "HTTP connections currently open, by state",
+			ConstLabels: labels,
+		}, []string{"state"}),
+		opened: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "api_http_connections_opened_total",
+			Help:        "HTTP connections opened",
+			ConstLabels: labels,
+		}),
+		closed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "api_http_connections_closed_total",
+			Help:        "HTTP connections closed",
+			ConstLabels: labels,
+		}),
+		hijacked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "api_http_connections_hijacked_total",
+			Help:        "HTTP connections hijacked by handlers, i.e. for websockets",
+			ConstLabels: labels,
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "api_http_connections_rejected_total",
+			Help:        "HTTP connections rejected because the connection limit was reached",
+			ConstLabels: labels,
+		}),
+	}
+
+	// Export every state, even before a connection is in it
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		t.current.WithLabelValues(state.String())
+	}
+
+	reg.MustRegister(t.current, t.opened, t.closed, t.hijacked, t.rejected)
+
+	return &t
+}
+
+// connState implements the ConnState hook of http.Server.
+//
+// Hijacked connections are no longer managed by the server, so they stop being
+// tracked by state, though they count towards the limit until they are closed.
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Move the connection out of its previous state
+	if prev, ok := t.states[c]; ok {
+		t.current.WithLabelValues(prev.String()).Dec()
+	}
+
+	switch state {
+	case http.StateNew:
+		t.opened.Inc()
+	case http.StateHijacked:
+		t.hijacked.Inc()
+		delete(t.states, c)
+		return
+	case http.StateClosed:
+		t.closed.Inc()
+		delete(t.states, c)
+		return
+	}
+
+	t.states[c] = state
+	t.current.WithLabelValues(state.String()).Inc()
+}
+
+// limit returns a listener that accepts connections from l, as long as fewer
+// than the maximum are open. Connections beyond the maximum are responded to
+// with a 503 and closed, before they reach the server, so none of their
+// requests are handled. If too many are already being responded to, they are
+// closed without a response. If the server serves TLS, tlsConfig must be its config,
+// so that the response can be sent over TLS.
+func (t *connTracker) limit(l net.Listener, tlsConfig *tls.Config) net.Listener {
+	if t.max <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, tracker: t, tlsConfig: tlsConfig}
+}
+
+// limitListener is a net.Listener that rejects connections beyond a maximum
+type limitListener struct {
+	net.Listener
+	tracker   *connTracker
+	tlsConfig *tls.Config
+}
+
+// Accept implements net.Listener
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if atomic.AddInt64(&l.tracker.open, 1) <= int64(l.tracker.max) {
+			return &limitConn{Conn: c, open: &l.tracker.open}, nil
+		}
+
+		atomic.AddInt64(&l.tracker.open, -1)
+		l.tracker.rejected.Inc()
+
+		// Respond without blocking the server's accept loop, unless too many
+		// rejected connections are being responded to already
+		select {
+		case l.tracker.rejecting <- struct{}{}:
+			go func() {
+				defer func() { <-l.tracker.rejecting }()
+				rejectConn(c, l.tlsConfig)
+			}()
+		default:
+			c.Close()
+		}
+	}
+}
+
+// limitConn is a connection that counts towards the limit until it is closed
+type limitConn struct {
+	net.Conn
+	open   *int64
+	closed int32
+}
+
+// Close implements net.Conn
+func (c *limitConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.open, -1)
+	}
+	return c.Conn.Close()
+}
+
+// rejectConn responds to the first request of a connection with a 503, then
+// closes it. If the connection negotiates HTTP/2 it is closed without a
+// response, as the response is HTTP/1.
+func rejectConn(c net.Conn, tlsConfig *tls.Config) {
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(time.Second))
+
+	if tlsConfig != nil {
+		tc := tls.Server(c, tlsConfig)
+		if err := tc.Handshake(); err != nil || tc.ConnectionState().NegotiatedProtocol == "h2" {
+			return
+		}
+		c = tc
+	}
+
+	// Read the request before responding, as clients discard responses that
+	// arrive before their request is sent
+	if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+		return
+	}
+
+	if _, err := c.Write(connRejectResponse); err != nil {
+		return
+	}
+
+	// Let the client read the response before closing, by closing our side and
+	// discarding anything it sent, as closing with unread data resets the
+	// connection.
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	io.Copy(ioutil.Discard, c)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connMetrics returns the connection metrics gathered from reg, by name, with
+// the connections in each state by the name of the state.
+func connMetrics(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if g := m.GetGauge(); g != nil {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "state" {
+						values[l.GetValue()] = g.GetValue()
+					}
+				}
+			}
+			if c := m.GetCounter(); c != nil {
+				values[mf.GetName()] = c.GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestConnState(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	tracker := newConnTracker(reg, prometheus.Labels{"listener": "public"}, 0)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	steps := []struct {
+		conn  net.Conn
+		state http.ConnState
+		want  map[string]float64
+	}{
+		{a, http.StateNew, map[string]float64{"new": 1, "api_http_connections_opened_total": 1}},
+		{b, http.StateNew, map[string]float64{"new": 2, "api_http_connections_opened_total": 2}},
+		{a, http.StateActive, map[string]float64{"new": 1, "active": 1}},
+		{a, http.StateIdle, map[string]float64{"new": 1, "active": 0, "idle": 1}},
+		{b, http.StateHijacked, map[string]float64{"new": 0, "idle": 1, "api_http_connections_hijacked_total": 1}},
+		{a, http.StateClosed, map[string]float64{"idle": 0, "api_http_connections_closed_total": 1}},
+	}
+
+	for i, step := range steps {
+		tracker.connState(step.conn, step.state)
+		got := connMetrics(t, reg)
+		for name, want := range step.want {
+			if got[name] != want {
+				t.Errorf("step %d (%s): %s = %v, want %v", i, step.state, name, got[name], want)
+			}
+		}
+	}
+}
+
+// limitedServer starts a server whose connections are tracked and limited by
+// tracker, returning it and a connection holding its only connection open.
+func limitedServer(t *testing.T, tracker *connTracker) (*httptest.Server, net.Conn) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = tracker.connState
+	srv.Listener = tracker.limit(srv.Listener, nil)
+	srv.Start()
+
+	// Hold the only connection open, with keep-alive
+	held, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	held.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(held), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	return srv, held
+}
+
+func TestConnLimit(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	tracker := newConnTracker(reg, nil, 1)
+	srv, held := limitedServer(t, tracker)
+	defer srv.Close()
+	defer held.Close()
+
+	// Further connections are rejected before reaching the server
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") != "1" || string(b) != connRejectBody {
+		t.Errorf("rejected with %d, Retry-After %q, body %s", res.StatusCode, res.Header.Get("Retry-After"), b)
+	}
+
+	got := connMetrics(t, reg)
+	if got["api_http_connections_rejected_total"] != 1 || got["api_http_connections_opened_total"] != 1 {
+		t.Errorf("metrics = %v, want 1 opened and 1 rejected", got)
+	}
+
+	// Once the held connection is closed, new connections are accepted
+	held.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %d after closing the held connection, want %d", res.StatusCode, http.StatusOK)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnLimitRejectingFull(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	tracker := newConnTracker(reg, nil, 1)
+	srv, held := limitedServer(t, tracker)
+	defer srv.Close()
+	defer held.Close()
+
+	// When too many rejected connections are being responded to, further ones
+	// are closed without a response
+	for i := 0; i < maxRejecting; i++ {
+		tracker.rejecting <- struct{}{}
+	}
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	if b, err := ioutil.ReadAll(c); len(b) > 0 || isTimeout(err) {
+		t.Errorf("read %q, %v, want the connection closed", b, err)
+	}
+
+	if got := connMetrics(t, reg)["api_http_connections_rejected_total"]; got != 1 {
+		t.Errorf("rejected = %v, want 1", got)
+	}
+}
+
+// isTimeout returns whether err is a timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestLimitConnCloseOnce(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	open := int64(1)
+	c := &limitConn{Conn: a, open: &open}
+	c.Close()
+	c.Close()
+
+	if open != 0 {
+		t.Errorf("open = %d after closing twice, want 0", open)
+	}
+}
+
+func TestConnLimitDisabled(t *testing.T) {
+	tracker := newConnTracker(prometheus.NewRegistry(), nil, 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if got := tracker.limit(l, nil); got != l {
+		t.Errorf("limit(l) = %T, want l unwrapped without a maximum", got)
+	}
+}
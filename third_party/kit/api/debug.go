@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// debugAPI exposes Prometheus metrics and pprof profiles
+type debugAPI struct {
+	gatherer prometheus.Gatherer
+}
+
+// NewDebugAPI returns an API exposing the metrics of the given gatherer on
+// /metrics, and pprof profiles under /debug/pprof/. It is intended to be
+// served on an internal listener of a MultiServer.
+func NewDebugAPI(g prometheus.Gatherer) API {
+	return &debugAPI{gatherer: g}
+}
+
+// Endpoints implements API
+func (a *debugAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method:  http.MethodGet,
+			Path:    "/metrics",
+			Handler: promhttp.HandlerFor(a.gatherer, promhttp.HandlerOpts{}),
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/debug/pprof/*profile",
+			Handler: http.HandlerFunc(pprofHandler),
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/debug/pprof/*profile",
+			Handler: http.HandlerFunc(pprofHandler),
+		},
+	}
+}
+
+// pprofHandler dispatches to the pprof handler for the requested profile.
+// httprouter cannot register static paths alongside a catch-all, so this is
+// done by hand.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch httprouter.ParamsFromContext(r.Context()).ByName("profile") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		// Index serves the index page, and any named profile, i.e. heap.
+		pprof.Index(w, r)
+	}
+}
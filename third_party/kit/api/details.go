@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ctxKey represents the type of value for the context key
+type ctxKey int
+
+// KeyDetails is how request details are stored and retrieved
+const KeyDetails ctxKey = 1
+
+// keyConn is how the connection a request was received on is stored and retrieved
+const keyConn ctxKey = 2
+
+// keyLogger is how the logger of the server handling a request is stored and retrieved
+const keyLogger ctxKey = 3
+
+// Details represent state for each request
+type Details struct {
+	Now         time.Time
+	RequestID   string
+	Method      string
+	RequestPath string
+	StatusCode  int
+	AbortReason string
+	Critical    bool
+	// Whether the response may select fields, see Endpoint.SparseFields.
+	SparseFields bool
+	// Principal identifies who made the request. It should be set by
+	// authentication middleware.
+	Principal string
+	// The trace context of the request, if it was propagated by the client.
+	TraceID      string
+	SpanID       string
+	TraceSampled bool
+	// The number of bytes read from the request body, and written to the
+	// response body.
+	RequestSize  int64
+	ResponseSize int64
+	// Whether the request should not be logged, and the number of requests
+	// not logged before it, as decided by LogPolicyMW.
+	SkipLog    bool
+	LogDropped int64
+}
+
+// StatusClientClosedRequest is recorded as the status code of requests whose
+// client went away before a response was written.
+const StatusClientClosedRequest = 499
+
+// The reasons a request may be aborted, recorded as the AbortReason of its
+// Details.
+const (
+	// AbortClientClosed means the client closed the request.
+	AbortClientClosed = "client_closed"
+	// AbortTimeout means the handler did not respond before its deadline.
+	AbortTimeout = "timeout"
+)
+
+// getDetails returns any Details found within the http.Request, or nil
+func getDetails(r *http.Request) *Details {
+	v, ok := r.Context().Value(KeyDetails).(*Details)
+	if !ok {
+		return nil
+	}
+	return v
+}
+
+// statusMW returns a middleware that records the final status of a request on
+// its Details, once the wrapped handler returns. Requests whose context ended
+// before the handler returned are recorded as aborted, with a 499 if the client
+// went away or a 504 if a deadline was exceeded. Otherwise, if the handler did
+// not respond using Respond, the status it wrote is recorded. The sizes of the
+// request and response bodies are always recorded.
+func statusMW() Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			rec := recorder{ResponseWriter: w}
+
+			// Count the request body as it is read, without modifying the request
+			// we were given
+			body := countingBody{ReadCloser: r.Body}
+			cr := *r
+			if r.Body != nil {
+				cr.Body = &body
+			}
+
+			// Call the wrapped handler
+			next.ServeHTTP(&rec, &cr)
+
+			d := getDetails(r)
+			if d == nil {
+				return
+			}
+
+			d.RequestSize = body.count()
+			d.ResponseSize = rec.size
+
+			switch {
+			case d.AbortReason != "":
+				// Already recorded, i.e. by a timeout middleware
+			case r.Context().Err() == context.Canceled:
+				d.AbortReason = AbortClientClosed
+				d.StatusCode = StatusClientClosedRequest
+			case r.Context().Err() == context.DeadlineExceeded:
+				d.AbortReason = AbortTimeout
+				d.StatusCode = http.StatusGatewayTimeout
+			case d.StatusCode == 0:
+				d.StatusCode = rec.status
+			}
+		}
+		return h
+	}
+}
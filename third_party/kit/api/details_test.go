@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// handleDetails handles the request with a server for the given endpoint,
+// with the given middleware, returning the details recorded for it.
+func handleDetails(r *http.Request, e Endpoint, mw ...Middleware) Details {
+	var d Details
+	record := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			d = *getDetails(r)
+		})
+	}
+	s := newServer(zap.NewNop().Sugar(), testAPI{e}, append([]Middleware{record}, mw...))
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	return d
+}
+
+// waitForCancel returns a handler that waits for its request to be cancelled.
+func waitForCancel() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+}
+
+func TestStatusMW(t *testing.T) {
+	// Responses are recorded with their status and sizes
+	d := handleDetails(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")), Endpoint{Method: http.MethodPost, Path: "/", Handler: readBody()})
+	if d.StatusCode != http.StatusOK || d.AbortReason != "" || d.RequestSize != 5 || d.ResponseSize != 5 {
+		t.Errorf("details = %+v, want a 200 of 5 bytes", d)
+	}
+
+	// Requests whose client went away are recorded as 499
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	d = handleDetails(r, Endpoint{Method: http.MethodGet, Path: "/", Handler: waitForCancel()})
+	if d.StatusCode != StatusClientClosedRequest || d.AbortReason != AbortClientClosed {
+		t.Errorf("status = %d, reason = %q, want 499 client_closed", d.StatusCode, d.AbortReason)
+	}
+
+	// Requests whose deadline passed are recorded as 504
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	r = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	d = handleDetails(r, Endpoint{Method: http.MethodGet, Path: "/", Handler: waitForCancel()})
+	if d.StatusCode != http.StatusGatewayTimeout || d.AbortReason != AbortTimeout {
+		t.Errorf("status = %d, reason = %q, want 504 timeout", d.StatusCode, d.AbortReason)
+	}
+
+	// As are requests that exceed the endpoint's timeout
+	d = handleDetails(httptest.NewRequest(http.MethodGet, "/", nil), Endpoint{Method: http.MethodGet, Path: "/", Handler: waitForCancel(), Timeout: time.Millisecond})
+	if d.StatusCode != http.StatusGatewayTimeout || d.AbortReason != AbortTimeout {
+		t.Errorf("status = %d, reason = %q, want 504 timeout", d.StatusCode, d.AbortReason)
+	}
+}
+
+func TestAbortedRequestsLogged(t *testing.T) {
+	var tl testLog
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+	// Aborted requests are always logged, even if successes are sampled
+	handleDetails(r, Endpoint{Method: http.MethodGet, Path: "/", Handler: waitForCancel()},
+		LogMW(tl.logger()), LogPolicyMW(LogPolicy{SampleRate: 1e-9}))
+	if entries := tl.entries(); len(entries) != 1 {
+		t.Errorf("logged %d entries, want 1", len(entries))
+	}
+}
+
+func TestAbortedRequestsMeasured(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := newMetricsMW(reg, nil)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handleDetails(httptest.NewRequest(http.MethodGet, "/", nil), Endpoint{Method: http.MethodGet, Path: "/", Handler: ok}, metrics)
+	handleDetails(httptest.NewRequest(http.MethodGet, "/", nil), Endpoint{Method: http.MethodGet, Path: "/", Handler: waitForCancel(), Timeout: time.Millisecond}, metrics)
+
+	// Aborted requests are counted, rather than their latency observed
+	counts := make(map[string]uint64)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if h := m.GetHistogram(); h != nil {
+				counts[mf.GetName()] += h.GetSampleCount()
+			}
+			if c := m.GetCounter(); c != nil {
+				counts[mf.GetName()] += uint64(c.GetValue())
+			}
+		}
+	}
+	if counts["api_http_latency_seconds"] != 1 || counts["api_http_aborted_total"] != 1 {
+		t.Errorf("counts = %v, want one observed and one aborted", counts)
+	}
+}
@@ -0,0 +1,4 @@
+// Package api provides a minimal framework for APIs.
+//
+// TODO.
+package api
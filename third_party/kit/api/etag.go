@@ -0,0 +1,152 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETag returns a strong ETag for the given version of a resource, i.e. a
+// version number or update time stored with the resource.
+func ETag(version interface{}) string {
+	// Quotes can't appear within an ETag
+	return `"` + strings.Replace(fmt.Sprint(version), `"`, "", -1) + `"`
+}
+
+// RespondETag responds as Respond does, setting the ETag of the response to the
+// given ETag, i.e. from ETag, or to a hash of the response body if it is
+// empty. Reads whose If-None-Match matches the ETag are responded to with a
+// 304, without a body.
+//
+// If the response selects fields, see Endpoint.SparseFields, the ETag is made
+// specific to the fields selected, as each selection is a different
+// representation of the resource.
+func RespondETag(w http.ResponseWriter, r *http.Request, status int, data interface{}, etag string) {
+	code, body := encodeResponse(r, status, data)
+	if code != status {
+		// The data can't be responded with, so there's nothing to tag
+		writeResponse(w, r, code, body)
+		return
+	}
+
+	switch {
+	case etag == "" && body != nil:
+		// Hash the body that is sent, so each representation has its own ETag
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	case etag != "":
+		etag = viewETag(etag, fieldsView(r))
+	}
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if status == http.StatusOK && isRead(r) && etag != "" {
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, false) {
+			writeResponse(w, r, http.StatusNotModified, nil)
+			return
+		}
+	}
+
+	writeResponse(w, r, status, body)
+}
+
+// viewETag returns the ETag of a view of a resource, i.e. one selecting some
+// of its fields, given the ETag of the whole resource.
+func viewETag(etag, view string) string {
+	if view == "" {
+		return etag
+	}
+	sum := sha256.Sum256([]byte(view))
+	return strings.TrimSuffix(etag, `"`) + "-" + hex.EncodeToString(sum[:4]) + `"`
+}
+
+// CheckPreconditions evaluates the If-Match and If-None-Match headers of a
+// request against the current ETag of the resource it is for, or an empty
+// ETag if the resource doesn't exist. It returns whether the request should
+// continue. If not, it has been responded to with a 412, or a 304 for reads
+// whose If-None-Match matches, with the ETag set.
+//
+// Handlers that modify resources should call this with the resource's current
+// ETag before doing so, so that clients can't overwrite changes they haven't
+// seen. Endpoints can require clients to do so with RequireIfMatch.
+func CheckPreconditions(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag != "" {
+		// Reads may be for a view of the resource, tagged as RespondETag does
+		etag = viewETag(etag, fieldsView(r))
+	}
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if etag == "" || !etagMatches(im, etag, true) {
+			// Tell the client the current ETag, so it can fetch the changes
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			RespondError(w, r, http.StatusPreconditionFailed)
+			return false
+		}
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etag != "" && etagMatches(inm, etag, false) {
+		w.Header().Set("ETag", etag)
+		if isRead(r) {
+			Respond(w, r, http.StatusNotModified, nil)
+		} else {
+			RespondError(w, r, http.StatusPreconditionFailed)
+		}
+		return false
+	}
+
+	return true
+}
+
+// etagMatches returns whether the list of ETags in a conditional header matches
+// etag. Strong comparison requires that neither ETag is weak.
+func etagMatches(header, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	weak := strings.HasPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong {
+			if !weak && candidate == etag {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isRead returns whether the request only reads a resource.
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// requireIfMatchMW returns a middleware that rejects requests that modify a
+// resource without an If-Match header with a 428, see Endpoint.RequireIfMatch.
+func requireIfMatchMW() Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPut, http.MethodPatch, http.MethodDelete:
+				if r.Header.Get("If-Match") == "" {
+					RespondError(w, r, http.StatusPreconditionRequired)
+					return
+				}
+			}
+
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
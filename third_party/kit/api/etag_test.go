@@ -0,0 +1,176 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// etagAccount is the resource responded with by etagEndpoint
+type etagAccount struct {
+	ID      string `json:"id"`
+	Balance int    `json:"balance"`
+}
+
+// etagEndpoint returns an endpoint responding with an account, tagged with the
+// given ETag, or a hash of the body if it is empty.
+func etagEndpoint(etag string) Endpoint {
+	return Endpoint{
+		Method:       http.MethodGet,
+		Path:         "/accounts/:id",
+		SparseFields: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !CheckPreconditions(w, r, etag) {
+				return
+			}
+			RespondETag(w, r, http.StatusOK, etagAccount{ID: "acc_1", Balance: 100}, etag)
+		}),
+	}
+}
+
+func TestETag(t *testing.T) {
+	if got, want := ETag(7), `"7"`; got != want {
+		t.Errorf("ETag(7) = %s, want %s", got, want)
+	}
+	if got, want := ETag(`a"b`), `"ab"`; got != want {
+		t.Errorf("ETag(a\"b) = %s, want %s", got, want)
+	}
+}
+
+func TestRespondETag(t *testing.T) {
+	for _, etag := range []string{"", ETag(7)} {
+		get := func(query, inm string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/accounts/acc_1"+query, nil)
+			if inm != "" {
+				r.Header.Set("If-None-Match", inm)
+			}
+			return handleTest(r, etagEndpoint(etag))
+		}
+
+		whole := get("", "")
+		if whole.Code != http.StatusOK || whole.Header().Get("ETag") == "" {
+			t.Fatalf("etag %q: got %d with ETag %q, want 200 with an ETag", etag, whole.Code, whole.Header().Get("ETag"))
+		}
+		if etag != "" && whole.Header().Get("ETag") != etag {
+			t.Errorf("ETag = %s, want %s", whole.Header().Get("ETag"), etag)
+		}
+
+		// Each view has its own ETag
+		view := get("?fields=id", "")
+		if view.Header().Get("ETag") == whole.Header().Get("ETag") {
+			t.Errorf("etag %q: a view has the same ETag as the whole resource, %s", etag, view.Header().Get("ETag"))
+		}
+		if other := get("?fields=balance", ""); other.Header().Get("ETag") == view.Header().Get("ETag") {
+			t.Errorf("etag %q: different views have the same ETag, %s", etag, view.Header().Get("ETag"))
+		}
+		if same := get("?fields=id,id", ""); same.Header().Get("ETag") != view.Header().Get("ETag") {
+			t.Errorf("etag %q: the same view has different ETags, %s and %s", etag, view.Header().Get("ETag"), same.Header().Get("ETag"))
+		}
+
+		tests := []struct {
+			name   string
+			query  string
+			inm    string
+			status int
+		}{
+			{"whole matches", "", whole.Header().Get("ETag"), http.StatusNotModified},
+			{"weak matches", "", "W/" + whole.Header().Get("ETag"), http.StatusNotModified},
+			{"any matches", "", "*", http.StatusNotModified},
+			{"list matches", "", `"other", ` + whole.Header().Get("ETag"), http.StatusNotModified},
+			{"other doesn't match", "", `"other"`, http.StatusOK},
+			{"view matches", "?fields=id", view.Header().Get("ETag"), http.StatusNotModified},
+			{"whole doesn't match view", "?fields=id", whole.Header().Get("ETag"), http.StatusOK},
+			{"view doesn't match whole", "", view.Header().Get("ETag"), http.StatusOK},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := get(tt.query, tt.inm)
+				if w.Code != tt.status {
+					t.Errorf("etag %q: status = %d, want %d", etag, w.Code, tt.status)
+				}
+				if w.Code == http.StatusNotModified && w.Body.Len() > 0 {
+					t.Errorf("etag %q: 304 has a body %s", etag, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	current := ETag(3)
+	tests := []struct {
+		name    string
+		method  string
+		etag    string
+		header  string
+		value   string
+		status  int
+		setETag bool
+	}{
+		{"no preconditions", http.MethodPut, current, "", "", http.StatusOK, false},
+		{"if-match matches", http.MethodPut, current, "If-Match", current, http.StatusOK, false},
+		{"if-match doesn't match", http.MethodPut, current, "If-Match", ETag(2), http.StatusPreconditionFailed, true},
+		{"if-match weak", http.MethodPut, current, "If-Match", "W/" + current, http.StatusPreconditionFailed, true},
+		{"if-match missing resource", http.MethodPut, "", "If-Match", "*", http.StatusPreconditionFailed, false},
+		{"if-match any", http.MethodPut, current, "If-Match", "*", http.StatusOK, false},
+		{"if-none-match read", http.MethodGet, current, "If-None-Match", current, http.StatusNotModified, true},
+		{"if-none-match write", http.MethodPut, current, "If-None-Match", "*", http.StatusPreconditionFailed, true},
+		{"if-none-match create", http.MethodPut, "", "If-None-Match", "*", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Endpoint{
+				Method: tt.method,
+				Path:   "/accounts/:id",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if CheckPreconditions(w, r, tt.etag) {
+						RespondError(w, r, http.StatusOK)
+					}
+				}),
+			}
+			r := httptest.NewRequest(tt.method, "/accounts/acc_1", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			w := handleTest(r, e)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("ETag") != ""; got != tt.setETag {
+				t.Errorf("ETag set = %t, want %t", got, tt.setETag)
+			}
+		})
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	tests := []struct {
+		method  string
+		ifMatch string
+		status  int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodPost, "", http.StatusOK},
+		{http.MethodPut, "", http.StatusPreconditionRequired},
+		{http.MethodPatch, "", http.StatusPreconditionRequired},
+		{http.MethodDelete, "", http.StatusPreconditionRequired},
+		{http.MethodPut, ETag(1), http.StatusOK},
+	}
+	for _, tt := range tests {
+		e := Endpoint{
+			Method:         tt.method,
+			Path:           "/accounts/:id",
+			RequireIfMatch: true,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				RespondError(w, r, http.StatusOK)
+			}),
+		}
+		r := httptest.NewRequest(tt.method, "/accounts/acc_1", nil)
+		if tt.ifMatch != "" {
+			r.Header.Set("If-Match", tt.ifMatch)
+		}
+		if w := handleTest(r, e); w.Code != tt.status {
+			t.Errorf("%s with If-Match %q: status = %d, want %d", tt.method, tt.ifMatch, w.Code, tt.status)
+		}
+	}
+}
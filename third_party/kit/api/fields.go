@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InvalidFieldsBody is the body of responses to requests for fields, or
+// expansions, that the response doesn't have.
+type InvalidFieldsBody struct {
+	Msg string `json:"msg"`
+	// The fields requested that the response doesn't have.
+	Invalid []string `json:"invalid"`
+	// The fields the response has.
+	Valid []string `json:"valid"`
+}
+
+// Expand returns whether the request asks for the named resource to be
+// embedded in the response, using ?expand=name. Handlers should only load
+// embedded resources that are asked for. Only GET requests to endpoints with
+// SparseFields can ask for resources to be embedded.
+//
+// Fields of a response type that hold embedded resources are tagged with
+// `api:"expand"`. Respond removes them from responses, unless they are asked
+// for.
+func Expand(r *http.Request, name string) bool {
+	if !sparseFields(r) {
+		return false
+	}
+	for _, e := range queryList(r, "expand") {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseFields returns whether the response to a request may select fields,
+// see Endpoint.SparseFields.
+func sparseFields(r *http.Request) bool {
+	d := getDetails(r)
+	return d != nil && d.SparseFields && isRead(r)
+}
+
+// fieldsView returns the fields and expansions a request selects, sorted, so
+// that requests for the same representation have the same view. It is empty
+// if the request selects the whole representation.
+func fieldsView(r *http.Request) string {
+	if !sparseFields(r) {
+		return ""
+	}
+	fields, expand := queryList(r, "fields"), queryList(r, "expand")
+	if len(fields) == 0 && len(expand) == 0 {
+		return ""
+	}
+	return "fields=" + strings.Join(uniqueSorted(fields), ",") + "&expand=" + strings.Join(uniqueSorted(expand), ",")
+}
+
+// uniqueSorted returns the distinct values of a list, sorted.
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for _, v := range values {
+		if len(unique) == 0 || v != unique[len(unique)-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// selectFields returns the data to respond to a request with, encoded as JSON,
+// keeping only the fields asked for with ?fields=a,b.c, and removing embedded
+// resources that aren't asked for with ?expand=b. Fields are given by their
+// path within the JSON encoding, with arrays being transparent, i.e. "id"
+// selects the id of every item of a list. If a field or expansion isn't known
+// for the type of data, an InvalidFieldsBody is returned instead, with false.
+func selectFields(r *http.Request, data interface{}) (interface{}, bool) {
+	fields, expand := queryList(r, "fields"), queryList(r, "expand")
+	info := fieldInfoOf(reflect.TypeOf(data))
+	if len(fields) == 0 && len(expand) == 0 && len(info.expandable) == 0 {
+		// There's nothing to do
+		return data, true
+	}
+
+	// Check every field asked for is known
+	var invalid []string
+	for _, f := range fields {
+		if !info.has(f) {
+			invalid = append(invalid, f)
+		}
+	}
+	if len(invalid) > 0 {
+		return InvalidFieldsBody{Msg: "Unknown fields", Invalid: invalid, Valid: info.fields}, false
+	}
+	for _, e := range expand {
+		if !info.expandable[e] {
+			invalid = append(invalid, e)
+		}
+	}
+	if len(invalid) > 0 {
+		return InvalidFieldsBody{Msg: "Unknown expansions", Invalid: invalid, Valid: info.expandableList()}, false
+	}
+
+	// Select the fields from the encoded data
+	b, err := json.Marshal(data)
+	if err != nil {
+		// Let the caller report the error
+		return data, true
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return data, true
+	}
+
+	expanded := make(map[string]bool)
+	for _, e := range expand {
+		expanded[e] = true
+	}
+	for path := range info.expandable {
+		if !expanded[path] {
+			removePath(v, strings.Split(path, "."))
+		}
+	}
+
+	if len(fields) > 0 {
+		tree := make(fieldTree)
+		for _, f := range fields {
+			tree.add(strings.Split(f, "."))
+		}
+		v = tree.prune(v)
+	}
+
+	return v, true
+}
+
+// queryList returns the comma separated values of the named query parameter.
+func queryList(r *http.Request, name string) []string {
+	var values []string
+	for _, q := range r.URL.Query()[name] {
+		for _, v := range strings.Split(q, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// fieldTree is a tree of the fields to keep, by path
+type fieldTree map[string]fieldTree
+
+// add adds the field with the given path to the tree.
+func (t fieldTree) add(path []string) {
+	child, ok := t[path[0]]
+	if ok && len(child) == 0 {
+		// The whole field is already kept
+		return
+	}
+	if len(path) == 1 {
+		// Keep the whole field, even if parts of it were asked for
+		t[path[0]] = fieldTree{}
+		return
+	}
+	if !ok {
+		child = make(fieldTree)
+		t[path[0]] = child
+	}
+	child.add(path[1:])
+}
+
+// prune returns v with only the fields in the tree.
+func (t fieldTree) prune(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range vv {
+			sub, ok := t[k]
+			switch {
+			case !ok:
+				delete(vv, k)
+			case len(sub) > 0:
+				vv[k] = sub.prune(child)
+			}
+		}
+	case []interface{}:
+		for i, item := range vv {
+			vv[i] = t.prune(item)
+		}
+	}
+	return v
+}
+
+// removePath removes the field at path from v.
+func removePath(v interface{}, path []string) {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(vv, path[0])
+			return
+		}
+		if child, ok := vv[path[0]]; ok {
+			removePath(child, path[1:])
+		}
+	case []interface{}:
+		for _, item := range vv {
+			removePath(item, path)
+		}
+	}
+}
+
+// fieldInfo describes the fields of the JSON encoding of a type
+type fieldInfo struct {
+	// The paths of all fields, sorted.
+	fields []string
+	known  map[string]bool
+	// The paths of fields whose contents can't be known from the type, i.e.
+	// maps and interfaces. Any path within these is allowed. The empty path
+	// means any field is allowed.
+	open []string
+	// The paths of fields tagged to be expanded.
+	expandable map[string]bool
+}
+
+// has returns whether the type has a field with the given path.
+func (fi *fieldInfo) has(path string) bool {
+	if fi.known[path] {
+		return true
+	}
+	for _, o := range fi.open {
+		if o == "" || strings.HasPrefix(path, o+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// expandableList returns the paths of the expandable fields, sorted.
+func (fi *fieldInfo) expandableList() []string {
+	list := make([]string, 0, len(fi.expandable))
+	for path := range fi.expandable {
+		list = append(list, path)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// fieldInfos caches the fieldInfo of types, as they never change
+var fieldInfos sync.Map
+
+// fieldInfoOf returns the fieldInfo of the given type.
+func fieldInfoOf(t reflect.Type) *fieldInfo {
+	if fi, ok := fieldInfos.Load(t); ok {
+		return fi.(*fieldInfo)
+	}
+
+	fi := fieldInfo{
+		known:      make(map[string]bool),
+		expandable: make(map[string]bool),
+	}
+	fi.walk(t, "", make(map[reflect.Type]bool))
+	for path := range fi.known {
+		fi.fields = append(fi.fields, path)
+	}
+	sort.Strings(fi.fields)
+
+	fieldInfos.Store(t, &fi)
+	return &fi
+}
+
+// walk adds the fields of the given type, found at prefix, to the fieldInfo.
+// seen holds the struct types being walked, so recursive types terminate.
+func (fi *fieldInfo) walk(t reflect.Type, prefix string, seen map[reflect.Type]bool) {
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as a string
+			return
+		}
+		t = t.Elem()
+	}
+
+	switch {
+	case t == nil, t.Kind() == reflect.Interface, t.Kind() == reflect.Map:
+		fi.open = append(fi.open, prefix)
+		return
+	case t.Kind() != reflect.Struct, seen[t]:
+		return
+	}
+	// Types that encode themselves can't be described
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return
+	}
+
+	seen[t] = true
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// Untagged embedded structs have their fields promoted
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fi.walk(ft, prefix, seen)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		fi.known[path] = true
+		if f.Tag.Get("api") == "expand" {
+			fi.expandable[path] = true
+		}
+		fi.walk(f.Type, path, seen)
+	}
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
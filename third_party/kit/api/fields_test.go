@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type testHolder struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type testAccount struct {
+	ID      string            `json:"id"`
+	Balance int               `json:"balance"`
+	Holder  *testHolder       `json:"holder,omitempty" api:"expand"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Secret  string            `json:"-"`
+}
+
+// accountEndpoint returns an endpoint responding with an account, embedding
+// its holder if asked to.
+func accountEndpoint(method string, status int, sparse bool) Endpoint {
+	return Endpoint{
+		Method:       method,
+		Path:         "/accounts/:id",
+		SparseFields: sparse,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a := testAccount{ID: "acc_1", Balance: 100, Meta: map[string]string{"a": "1", "b": "2"}}
+			if Expand(r, "holder") {
+				a.Holder = &testHolder{Name: "Ann", Email: "ann@example.com"}
+			}
+			Respond(w, r, status, a)
+		}),
+	}
+}
+
+// decode decodes a JSON body.
+func decode(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("invalid JSON %q: %v", b, err)
+	}
+	return v
+}
+
+func TestSparseFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{
+			name:   "whole resource",
+			status: http.StatusOK,
+			body:   `{"id":"acc_1","balance":100,"meta":{"a":"1","b":"2"}}`,
+		},
+		{
+			name:   "fields",
+			query:  "?fields=id,balance",
+			status: http.StatusOK,
+			body:   `{"id":"acc_1","balance":100}`,
+		},
+		{
+			name:   "expanded",
+			query:  "?expand=holder",
+			status: http.StatusOK,
+			body:   `{"id":"acc_1","balance":100,"meta":{"a":"1","b":"2"},"holder":{"name":"Ann","email":"ann@example.com"}}`,
+		},
+		{
+			name:   "fields of expanded",
+			query:  "?fields=id,holder.name&expand=holder",
+			status: http.StatusOK,
+			body:   `{"id":"acc_1","holder":{"name":"Ann"}}`,
+		},
+		{
+			name:   "fields within map",
+			query:  "?fields=meta.a",
+			status: http.StatusOK,
+			body:   `{"meta":{"a":"1"}}`,
+		},
+		{
+			name:   "unknown field",
+			query:  "?fields=id,secret",
+			status: http.StatusBadRequest,
+			body:   `{"msg":"Unknown fields","invalid":["secret"],"valid":["balance","holder","holder.email","holder.name","id","meta"]}`,
+		},
+		{
+			name:   "unknown expansion",
+			query:  "?expand=owner",
+			status: http.StatusBadRequest,
+			body:   `{"msg":"Unknown expansions","invalid":["owner"],"valid":["holder"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := handleTest(httptest.NewRequest(http.MethodGet, "/accounts/acc_1"+tt.query, nil), accountEndpoint(http.MethodGet, http.StatusOK, true))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got, want := decode(t, w.Body.Bytes()), decode(t, []byte(tt.body)); !reflect.DeepEqual(got, want) {
+				t.Errorf("body = %s, want %s", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestSparseFieldsList(t *testing.T) {
+	e := Endpoint{
+		Method:       http.MethodGet,
+		Path:         "/accounts",
+		SparseFields: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Respond(w, r, http.StatusOK, []testAccount{{ID: "acc_1", Balance: 1}, {ID: "acc_2", Balance: 2}})
+		}),
+	}
+
+	w := handleTest(httptest.NewRequest(http.MethodGet, "/accounts?fields=id", nil), e)
+	if got, want := w.Body.String(), `[{"id":"acc_1"},{"id":"acc_2"}]`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestSparseFieldsOptIn(t *testing.T) {
+	whole := `{"id":"acc_1","balance":100,"meta":{"a":"1","b":"2"}}`
+	tests := []struct {
+		name   string
+		method string
+		status int
+		sparse bool
+		body   string
+	}{
+		{"not enabled", http.MethodGet, http.StatusOK, false, whole},
+		{"write", http.MethodPost, http.StatusCreated, true, whole},
+		// Error responses aren't pruned, but are still responded with
+		{"error", http.MethodGet, http.StatusNotFound, true, `{"id":"acc_1","balance":100,"holder":{"name":"Ann","email":"ann@example.com"},"meta":{"a":"1","b":"2"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/accounts/acc_1?fields=bogus&expand=holder", nil)
+			w := handleTest(r, accountEndpoint(tt.method, tt.status, tt.sparse))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body = %s, want %s", got, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FilterOp is an operator of a filter comparison.
+type FilterOp string
+
+// The operators of filter comparisons
+const (
+	FilterEq         FilterOp = "eq"
+	FilterNe         FilterOp = "ne"
+	FilterGt         FilterOp = "gt"
+	FilterGe         FilterOp = "ge"
+	FilterLt         FilterOp = "lt"
+	FilterLe         FilterOp = "le"
+	FilterIn         FilterOp = "in"
+	FilterContains   FilterOp = "contains"
+	FilterStartsWith FilterOp = "startswith"
+)
+
+// filterOps are all of the operators of filter comparisons
+var filterOps = map[FilterOp]bool{
+	FilterEq: true, FilterNe: true, FilterGt: true, FilterGe: true, FilterLt: true,
+	FilterLe: true, FilterIn: true, FilterContains: true, FilterStartsWith: true,
+}
+
+// The limits of filters, so that parsing them is cheap, and their queries are
+// bounded.
+const (
+	// maxFilterLength is the maximum length of a filter, in bytes.
+	maxFilterLength = 2048
+	// maxFilterDepth is the maximum nesting of a filter's parentheses and nots.
+	maxFilterDepth = 16
+)
+
+// FilterFields is the allow-list of the fields an endpoint can be filtered by,
+// and the operators each of them can be compared with.
+type FilterFields map[string][]FilterOp
+
+// FilterExpr is a node of a parsed filter, one of FilterAnd, FilterOr,
+// FilterNot or FilterComparison. Storage layers translate filters into their
+// own queries, i.e. SQL, by switching on the type of each node.
+type FilterExpr interface {
+	fmt.Stringer
+	filterExpr()
+}
+
+// FilterAnd matches when all of its expressions match.
+type FilterAnd struct {
+	Exprs []FilterExpr
+}
+
+// FilterOr matches when any of its expressions match.
+type FilterOr struct {
+	Exprs []FilterExpr
+}
+
+// FilterNot matches when its expression doesn't.
+type FilterNot struct {
+	Expr FilterExpr
+}
+
+// FilterComparison compares a field with a value. Values are a string, int64,
+// float64, bool or nil for null. The value of an in comparison is a
+// []interface{} of these.
+type FilterComparison struct {
+	Field string
+	Op    FilterOp
+	Value interface{}
+}
+
+func (FilterAnd) filterExpr()        {}
+func (FilterOr) filterExpr()         {}
+func (FilterNot) filterExpr()        {}
+func (FilterComparison) filterExpr() {}
+
+// String implements fmt.Stringer
+func (e FilterAnd) String() string { return joinFilterExprs(e.Exprs, " and ") }
+
+// String implements fmt.Stringer
+func (e FilterOr) String() string { return joinFilterExprs(e.Exprs, " or ") }
+
+// String implements fmt.Stringer
+func (e FilterNot) String() string { return "not (" + e.Expr.String() + ")" }
+
+// String implements fmt.Stringer
+func (e FilterComparison) String() string {
+	if values, ok := e.Value.([]interface{}); ok {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = formatFilterValue(v)
+		}
+		return fmt.Sprintf("%s %s (%s)", e.Field, e.Op, strings.Join(s, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", e.Field, e.Op, formatFilterValue(e.Value))
+}
+
+// joinFilterExprs formats exprs joined by sep, in parentheses.
+func joinFilterExprs(exprs []FilterExpr, sep string) string {
+	s := make([]string, len(exprs))
+	for i, e := range exprs {
+		s[i] = e.String()
+	}
+	return "(" + strings.Join(s, sep) + ")"
+}
+
+// formatFilterValue formats v as it is written in a filter.
+func formatFilterValue(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + strings.Replace(vv, "'", "''", -1) + "'"
+	default:
+		return fmt.Sprint(vv)
+	}
+}
+
+// SortField is a field to sort by, and its direction.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// QueryError is returned by ParseFilter and ParseSort when their query
+// parameter is invalid.
+type QueryError struct {
+	// Param is the query parameter, i.e. "filter".
+	Param string
+	// Pos is the position in the parameter of the error, starting from 1, or 0
+	// if the error isn't at a position.
+	Pos int
+	Msg string
+}
+
+// Error implements error
+func (e *QueryError) Error() string {
+	if e.Pos > 0 {
+		return fmt.Sprintf("invalid %s: %s at position %d", e.Param, e.Msg, e.Pos)
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Param, e.Msg)
+}
+
+// QueryErrorBody is the body of responses to requests with invalid query
+// parameters.
+type QueryErrorBody struct {
+	Msg   string `json:"msg"`
+	Param string `json:"param,omitempty"`
+	Pos   int    `json:"pos,omitempty"`
+}
+
+// RespondQueryError responds to a request whose query parameters couldn't be
+// parsed with a 400, describing the error if it is a QueryError.
+func RespondQueryError(w http.ResponseWriter, r *http.Request, err error) {
+	if qe, ok := err.(*QueryError); ok {
+		Respond(w, r, http.StatusBadRequest, QueryErrorBody{Msg: qe.Error(), Param: qe.Param, Pos: qe.Pos})
+		return
+	}
+	RespondError(w, r, http.StatusBadRequest)
+}
+
+// ParseFilter parses the ?filter of a request, i.e.
+//
+//	status eq 'open' and (currency eq 'GBP' or currency in ('EUR', 'USD'))
+//
+// Comparisons are a field, an operator and a value, and are combined with and,
+// or, not and parentheses. Values are strings in single quotes, with quotes
+// escaped by doubling them, numbers, true, false and null. Only the given
+// fields, with their operators, can be filtered by. Filters are limited to
+// 2048 bytes, nested at most 16 deep. It returns nil if the request has no
+// filter.
+func ParseFilter(r *http.Request, fields FilterFields) (FilterExpr, error) {
+	s := r.URL.Query().Get("filter")
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	if len(s) > maxFilterLength {
+		return nil, &QueryError{Param: "filter", Msg: fmt.Sprintf("longer than %d bytes", maxFilterLength)}
+	}
+
+	p := filterParser{fields: fields}
+	if err := p.lex(s); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return expr, nil
+}
+
+// ParseSort parses the ?sort of a request, a comma separated list of fields,
+// each prefixed with - to sort descending, or optionally + to sort ascending,
+// i.e. "-created_at,id". Only the given fields can be sorted by. It returns nil
+// if the request has no sort.
+func ParseSort(r *http.Request, fields []string) ([]SortField, error) {
+	s := r.URL.Query().Get("sort")
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, f := range fields {
+		allowed[f] = true
+	}
+
+	var sorts []SortField
+	seen := make(map[string]bool)
+	pos := 1
+	for _, part := range strings.Split(s, ",") {
+		field := strings.TrimSpace(part)
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimLeft(field, "+-")
+		fieldPos := pos + strings.Index(part, field)
+		pos += len(part) + 1
+
+		switch {
+		case field == "":
+			return nil, &QueryError{Param: "sort", Pos: fieldPos, Msg: "missing field"}
+		case !allowed[field]:
+			return nil, &QueryError{Param: "sort", Pos: fieldPos, Msg: fmt.Sprintf("can't sort by %q, only by %s", field, strings.Join(fields, ", "))}
+		case seen[field]:
+			return nil, &QueryError{Param: "sort", Pos: fieldPos, Msg: fmt.Sprintf("%q is sorted by more than once", field)}
+		}
+		seen[field] = true
+		sorts = append(sorts, SortField{Field: field, Desc: desc})
+	}
+	return sorts, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+// token is a token of a filter
+type token struct {
+	kind tokenKind
+	text string
+	// The value of string and number tokens
+	value interface{}
+	// The position of the token, starting from 1
+	pos int
+}
+
+// String implements fmt.Stringer
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(t.text)
+}
+
+// filterParser is a recursive descent parser of filters
+type filterParser struct {
+	fields FilterFields
+	tokens []token
+	next   int
+	// The nesting of the expression being parsed.
+	depth int
+}
+
+// lex splits s into tokens.
+func (p *filterParser) lex(s string) error {
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '(':
+			p.tokens = append(p.tokens, token{kind: tokenLParen, text: "(", pos: start + 1})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, token{kind: tokenRParen, text: ")", pos: start + 1})
+			i++
+		case c == ',':
+			p.tokens = append(p.tokens, token{kind: tokenComma, text: ",", pos: start + 1})
+			i++
+		case c == '\'':
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(rs) {
+					return &QueryError{Param: "filter", Pos: start + 1, Msg: "unterminated string"}
+				}
+				if rs[i] == '\'' {
+					// Quotes are escaped by doubling them
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						b.WriteRune('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(rs[i])
+			}
+			p.tokens = append(p.tokens, token{kind: tokenString, text: string(rs[start:i]), value: b.String(), pos: start + 1})
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			for i++; i < len(rs) && (unicode.IsDigit(rs[i]) || strings.ContainsRune(".eE+-", rs[i])); i++ {
+			}
+			text := string(rs[start:i])
+			var value interface{}
+			if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+				value = n
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				value = f
+			} else {
+				return &QueryError{Param: "filter", Pos: start + 1, Msg: fmt.Sprintf("invalid number %q", text)}
+			}
+			p.tokens = append(p.tokens, token{kind: tokenNumber, text: text, value: value, pos: start + 1})
+		case c == '_' || unicode.IsLetter(c):
+			for i++; i < len(rs) && (rs[i] == '_' || rs[i] == '.' || unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i])); i++ {
+			}
+			p.tokens = append(p.tokens, token{kind: tokenIdent, text: string(rs[start:i]), pos: start + 1})
+		default:
+			return &QueryError{Param: "filter", Pos: start + 1, Msg: fmt.Sprintf("unexpected %q", c)}
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokenEOF, pos: len(rs) + 1})
+	return nil
+}
+
+// peek returns the next token, without consuming it.
+func (p *filterParser) peek() token {
+	return p.tokens[p.next]
+}
+
+// take consumes and returns the next token.
+func (p *filterParser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// keyword returns whether the next token is the given keyword, consuming it if
+// so. Keywords are case insensitive.
+func (p *filterParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokenIdent && strings.EqualFold(t.text, kw) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+// errorf returns a QueryError at the position of the given token.
+func (p *filterParser) errorf(t token, format string, a ...interface{}) error {
+	return &QueryError{Param: "filter", Pos: t.pos, Msg: fmt.Sprintf(format, a...)}
+}
+
+// parseOr parses: and ("or" and)*
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	var exprs []FilterExpr
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.keyword("or") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return FilterOr{Exprs: exprs}, nil
+}
+
+// parseAnd parses: unary ("and" unary)*
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	var exprs []FilterExpr
+	for {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.keyword("and") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return FilterAnd{Exprs: exprs}, nil
+}
+
+// parseUnary parses: "not" unary | "(" or ")" | comparison
+func (p *filterParser) parseUnary() (FilterExpr, error) {
+	if t := p.peek(); t.kind == tokenLParen || (t.kind == tokenIdent && strings.EqualFold(t.text, "not")) {
+		if p.depth == maxFilterDepth {
+			return nil, p.errorf(t, "nested more than %d deep", maxFilterDepth)
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+	}
+
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return FilterNot{Expr: expr}, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.take()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.take(); t.kind != tokenRParen {
+			return nil, p.errorf(t, "expected \")\", got %s", t)
+		}
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+// parseComparison parses: field op value | field "in" "(" value ("," value)* ")"
+func (p *filterParser) parseComparison() (FilterExpr, error) {
+	field := p.take()
+	if field.kind != tokenIdent {
+		return nil, p.errorf(field, "expected a field, got %s", field)
+	}
+	ops, ok := p.fields[field.text]
+	if !ok {
+		return nil, p.errorf(field, "can't filter by %q, only by %s", field.text, strings.Join(p.fieldNames(), ", "))
+	}
+
+	opTok := p.take()
+	op := FilterOp(strings.ToLower(opTok.text))
+	if opTok.kind != tokenIdent || !filterOps[op] {
+		return nil, p.errorf(opTok, "expected an operator, got %s", opTok)
+	}
+	if !allowsOp(ops, op) {
+		return nil, p.errorf(opTok, "can't filter %q with %s, only with %s", field.text, op, joinOps(ops))
+	}
+
+	if op != FilterIn {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return FilterComparison{Field: field.text, Op: op, Value: value}, nil
+	}
+
+	if t := p.take(); t.kind != tokenLParen {
+		return nil, p.errorf(t, "expected \"(\", got %s", t)
+	}
+	var values []interface{}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		t := p.take()
+		if t.kind == tokenRParen {
+			break
+		}
+		if t.kind != tokenComma {
+			return nil, p.errorf(t, "expected \",\" or \")\", got %s", t)
+		}
+	}
+	return FilterComparison{Field: field.text, Op: op, Value: values}, nil
+}
+
+// parseValue parses: string | number | "true" | "false" | "null"
+func (p *filterParser) parseValue() (interface{}, error) {
+	t := p.take()
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return t.value, nil
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, p.errorf(t, "expected a value, got %s", t)
+}
+
+// fieldNames returns the fields that can be filtered by, sorted.
+func (p *filterParser) fieldNames() []string {
+	names := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allowsOp returns whether op is one of ops.
+func allowsOp(ops []FilterOp, op FilterOp) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// joinOps formats a list of operators.
+func joinOps(ops []FilterOp) string {
+	s := make([]string, len(ops))
+	for i, op := range ops {
+		s[i] = string(op)
+	}
+	return strings.Join(s, ", ")
+}
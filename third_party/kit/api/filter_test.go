@@ -0,0 +1,159 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFilterFields are the fields filters are parsed with in tests.
+var testFilterFields = FilterFields{
+	"status":     {FilterEq, FilterNe, FilterIn},
+	"currency":   {FilterEq, FilterIn},
+	"amount":     {FilterGt, FilterLt},
+	"name":       {FilterContains, FilterStartsWith},
+	"closed":     {FilterEq},
+	"created_at": {FilterGe},
+}
+
+// queryRequest returns a request with the given query parameter.
+func queryRequest(param, value string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/accounts?"+param+"="+url.QueryEscape(value), nil)
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   FilterExpr
+	}{
+		{filter: "", want: nil},
+		{filter: "status eq 'open'", want: FilterComparison{Field: "status", Op: FilterEq, Value: "open"}},
+		{filter: "name contains 'o''brien'", want: FilterComparison{Field: "name", Op: FilterContains, Value: "o'brien"}},
+		{filter: "amount gt -10 and amount lt 2.5e3", want: FilterAnd{Exprs: []FilterExpr{
+			FilterComparison{Field: "amount", Op: FilterGt, Value: int64(-10)},
+			FilterComparison{Field: "amount", Op: FilterLt, Value: 2500.0},
+		}}},
+		{filter: "closed EQ true or status ne null", want: FilterOr{Exprs: []FilterExpr{
+			FilterComparison{Field: "closed", Op: FilterEq, Value: true},
+			FilterComparison{Field: "status", Op: FilterNe, Value: nil},
+		}}},
+		{filter: "status eq 'open' and (currency eq 'GBP' or currency in ('EUR', 'USD'))", want: FilterAnd{Exprs: []FilterExpr{
+			FilterComparison{Field: "status", Op: FilterEq, Value: "open"},
+			FilterOr{Exprs: []FilterExpr{
+				FilterComparison{Field: "currency", Op: FilterEq, Value: "GBP"},
+				FilterComparison{Field: "currency", Op: FilterIn, Value: []interface{}{"EUR", "USD"}},
+			}},
+		}}},
+		{filter: "not not (closed eq false)", want: FilterNot{Expr: FilterNot{Expr: FilterComparison{Field: "closed", Op: FilterEq, Value: false}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := ParseFilter(queryRequest("filter", tt.filter), testFilterFields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFilter() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterString(t *testing.T) {
+	filter := "status eq 'o''pen' and (currency eq 'GBP' or currency in ('EUR', 'USD')) and not (closed eq null)"
+	expr, err := ParseFilter(queryRequest("filter", filter), testFilterFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(status eq 'o''pen' and (currency eq 'GBP' or currency in ('EUR', 'USD')) and not (closed eq null))"
+	if got := expr.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+		msg    string
+	}{
+		{filter: "status eq 'open", pos: 11, msg: "unterminated string"},
+		{filter: "status eq 1.2.3", pos: 11, msg: "invalid number"},
+		{filter: "status eq 'open' ;", pos: 18, msg: "unexpected ';'"},
+		{filter: "owner eq 'me'", pos: 1, msg: `can't filter by "owner"`},
+		{filter: "status gt 'open'", pos: 8, msg: `can't filter "status" with gt`},
+		{filter: "status is 'open'", pos: 8, msg: "expected an operator"},
+		{filter: "status eq", pos: 10, msg: "expected a value"},
+		{filter: "(status eq 'open'", pos: 18, msg: `expected ")"`},
+		{filter: "status in 'open'", pos: 11, msg: `expected "("`},
+		{filter: "status in ('open' 'closed')", pos: 19, msg: `expected "," or ")"`},
+		{filter: "status eq 'open' closed", pos: 18, msg: `unexpected "closed"`},
+		{filter: strings.Repeat("(", 17) + "closed eq true" + strings.Repeat(")", 17), pos: 17, msg: "nested more than 16 deep"},
+		{filter: strings.Repeat("not ", 17) + "closed eq true", pos: 65, msg: "nested more than 16 deep"},
+		{filter: "status in ('" + strings.Repeat("x", 2048) + "')", msg: "longer than 2048 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			_, err := ParseFilter(queryRequest("filter", tt.filter), testFilterFields)
+			qe, ok := err.(*QueryError)
+			if !ok {
+				t.Fatalf("error = %v, want a QueryError", err)
+			}
+			if qe.Param != "filter" || qe.Pos != tt.pos || !strings.Contains(qe.Msg, tt.msg) {
+				t.Errorf("error = %+v, want %q at %d", qe, tt.msg, tt.pos)
+			}
+		})
+	}
+
+	// Filters nested up to the limit are fine
+	filter := strings.Repeat("(", 16) + "closed eq true" + strings.Repeat(")", 16)
+	if _, err := ParseFilter(queryRequest("filter", filter), testFilterFields); err != nil {
+		t.Errorf("filter nested 16 deep: %v", err)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	fields := []string{"created_at", "id", "name"}
+
+	got, err := ParseSort(queryRequest("sort", "-created_at, +id,name"), fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SortField{{Field: "created_at", Desc: true}, {Field: "id"}, {Field: "name"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSort() = %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		sort string
+		pos  int
+		msg  string
+	}{
+		{sort: "id,", pos: 4, msg: "missing field"},
+		{sort: "id,-owner", pos: 5, msg: `can't sort by "owner"`},
+		{sort: "id,-id", pos: 5, msg: `"id" is sorted by more than once`},
+	}
+	for _, tt := range tests {
+		_, err := ParseSort(queryRequest("sort", tt.sort), fields)
+		qe, ok := err.(*QueryError)
+		if !ok || qe.Param != "sort" || qe.Pos != tt.pos || !strings.Contains(qe.Msg, tt.msg) {
+			t.Errorf("sort %q: error = %v, want %q at %d", tt.sort, err, tt.msg, tt.pos)
+		}
+	}
+}
+
+func TestRespondQueryError(t *testing.T) {
+	_, err := ParseSort(queryRequest("sort", "owner"), []string{"id"})
+
+	w := httptest.NewRecorder()
+	RespondQueryError(w, queryRequest("sort", "owner"), err)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"param":"sort"`) || !strings.Contains(body, `"pos":1`) {
+		t.Errorf("body = %s", body)
+	}
+}
@@ -0,0 +1,15 @@
+package api
+
+import "net/http"
+
+// enableH2C enables HTTP/2 without TLS, alongside HTTP/1, on the given server.
+// It uses the h2c support added to net/http in Go 1.24, which is why kit
+// requires Go 1.24 or later.
+func enableH2C(s *http.Server) error {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	s.Protocols = &p
+	return nil
+}
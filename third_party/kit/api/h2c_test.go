@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestListenAndServeH2C(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-h2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	cfg := ServerConfig{Addr: "unix:" + path, SocketMode: 0600, H2C: true}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	go cfg.ListenAndServe(zap.NewNop().Sugar(), s)
+	defer s.Close()
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	// Both HTTP/1 and HTTP/2 with prior knowledge are served without TLS
+	var h2 http.Protocols
+	h2.SetUnencryptedHTTP2(true)
+	clients := map[string]*http.Client{
+		"HTTP/1.1": unixClient(path),
+		"HTTP/2.0": {Transport: &http.Transport{DialContext: dial, Protocols: &h2}},
+	}
+
+	for want, c := range clients {
+		// Wait for the server to be listening
+		getStatus(t, c, "/")
+
+		res, err := c.Get("http://unix/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != want || res.Proto != want {
+			t.Errorf("served %q, response %s, want %s", b, res.Proto, want)
+		}
+	}
+}
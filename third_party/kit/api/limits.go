@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBodyTooLarge is returned when reading a request body that is larger than
+// the MaxBodyBytes of its Endpoint. Handlers that fail to read the body with
+// this error should respond with a 413, or leave the response to the server.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// timeoutMW returns a middleware that applies the given deadline to the
+// request context. If the wrapped handler does not respond before the
+// deadline, a 504 is returned and the request is marked as timed out.
+//
+// The wrapped handler runs in its own goroutine, writing to a buffer, so the
+// response can be replaced if the deadline is reached.
+func timeoutMW(dt time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), dt)
+			defer cancel()
+
+			// Give the handler its own copy of the request details, so it cannot
+			// race with us updating them on timeout. They are copied back if the
+			// handler responds in time.
+			d := getDetails(r)
+			var hd *Details
+			if d != nil {
+				c := *d
+				hd = &c
+				ctx = context.WithValue(ctx, KeyDetails, hd)
+			}
+
+			tw := timeoutWriter{h: w.Header().Clone()}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(&tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// Re-panic in the serving goroutine, so the http.Server can handle it.
+				panic(p)
+
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				// Copy the buffered response to the real writer. If the handler
+				// wrote nothing, neither do we, so the middleware we are wrapped
+				// in, i.e. bodyLimitMW, can still respond.
+				dst := w.Header()
+				for k, v := range tw.h {
+					dst[k] = v
+				}
+				if tw.status != 0 {
+					w.WriteHeader(tw.status)
+					w.Write(tw.buf.Bytes())
+				}
+
+				if d != nil {
+					*d = *hd
+				}
+
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				// Stop the handler from writing anything more
+				tw.timedOut = true
+
+				// Only respond if our deadline was reached. Otherwise the client has
+				// gone away, and there is no-one to respond to.
+				if ctx.Err() == context.DeadlineExceeded {
+					if d != nil {
+						d.AbortReason = AbortTimeout
+					}
+					RespondError(w, r, http.StatusGatewayTimeout)
+				}
+			}
+		}
+		return h
+	}
+}
+
+// timeoutWriter buffers a response, until it is either copied to the real
+// http.ResponseWriter or discarded because of a timeout.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	h        http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+// Header implements http.ResponseWriter
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+// WriteHeader implements http.ResponseWriter
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+// Write implements http.ResponseWriter
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// bodyLimitMW returns a middleware that limits the size of request bodies to
+// the given number of bytes. Requests that declare a larger Content-Length are
+// rejected with a 413. Reads past the limit of other requests fail with
+// ErrBodyTooLarge, and if the handler then writes no response, a 413 is
+// returned for it.
+func bodyLimitMW(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			// Reject early if we know the body is too large
+			if r.ContentLength > n {
+				RespondError(w, r, http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// Limit the body, without modifying the request we were given
+			body := limitedBody{ReadCloser: r.Body, remaining: n}
+			lr := *r
+			lr.Body = &body
+
+			rec := recorder{ResponseWriter: w}
+			next.ServeHTTP(&rec, &lr)
+
+			if body.isExceeded() && rec.status == 0 {
+				RespondError(w, r, http.StatusRequestEntityTooLarge)
+			}
+		}
+		return h
+	}
+}
+
+// limitedBody is a request body that fails with ErrBodyTooLarge when more
+// than the remaining number of bytes are read from it. Whether the limit was
+// exceeded is updated atomically, as a timed out handler may still be reading.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+// Read implements io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.isExceeded() {
+		return 0, ErrBodyTooLarge
+	}
+
+	// Read one byte more than allowed, so we know if the limit is exceeded.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+
+	if int64(n) > b.remaining {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return int(b.remaining), ErrBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// isExceeded returns whether a read has exceeded the limit.
+func (b *limitedBody) isExceeded() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// writeTimeoutMW returns a middleware that sets the write deadline of the
+// connection a request was received on. HTTP/2 connections are shared by many
+// requests, so only HTTP/1.x requests are affected.
+func writeTimeoutMW(dt time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := r.Context().Value(keyConn).(net.Conn); ok && r.ProtoMajor == 1 {
+				c.SetWriteDeadline(time.Now().Add(dt))
+			}
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// withConn adds the connection to the context of requests received on it.
+// It should be used as the ConnContext of a http.Server.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, keyConn, c)
+}
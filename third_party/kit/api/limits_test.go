@@ -0,0 +1,144 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readBody returns a handler reading the request body, which responds with
+// the body, or writes nothing if it can't be read.
+func readBody() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Write(b)
+	})
+}
+
+// bodyRequest returns a request with the given body, whose length is only
+// declared if declare is set.
+func bodyRequest(body string, declare bool) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if !declare {
+		r.ContentLength = -1
+	}
+	return r
+}
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		declare bool
+		timeout time.Duration
+		status  int
+	}{
+		{name: "within limit", body: "12345", status: http.StatusOK},
+		{name: "declared too large", body: "123456", declare: true, status: http.StatusRequestEntityTooLarge},
+		{name: "read too large", body: "123456", status: http.StatusRequestEntityTooLarge},
+		{name: "within limit with timeout", body: "12345", timeout: time.Second, status: http.StatusOK},
+		{name: "declared too large with timeout", body: "123456", declare: true, timeout: time.Second, status: http.StatusRequestEntityTooLarge},
+		{name: "read too large with timeout", body: "123456", timeout: time.Second, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Endpoint{
+				Method:       http.MethodPost,
+				Path:         "/",
+				Handler:      readBody(),
+				MaxBodyBytes: 5,
+				Timeout:      tt.timeout,
+			}
+
+			w := handleTest(bodyRequest(tt.body, tt.declare), e)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestBodyLimitHandlerResponds(t *testing.T) {
+	// Handlers that respond to a body that is too large keep their response
+	for _, timeout := range []time.Duration{0, time.Second} {
+		e := Endpoint{
+			Method: http.MethodPost,
+			Path:   "/",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := ioutil.ReadAll(r.Body); err == ErrBodyTooLarge {
+					RespondError(w, r, http.StatusBadRequest)
+				}
+			}),
+			MaxBodyBytes: 5,
+			Timeout:      timeout,
+		}
+
+		w := handleTest(bodyRequest("123456", false), e)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("timeout %s: status = %d, want %d", timeout, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var details Details
+	e := Endpoint{
+		Method: http.MethodGet,
+		Path:   "/",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			// Writes after the timeout are discarded
+			w.Write([]byte("late"))
+		}),
+		Timeout: 10 * time.Millisecond,
+	}
+
+	// Record the details once the request has finished
+	s := newServer(zap.NewNop().Sugar(), testAPI{e}, []Middleware{func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			details = *getDetails(r)
+		})
+	}})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	if strings.Contains(w.Body.String(), "late") {
+		t.Errorf("body = %q, written after the timeout", w.Body)
+	}
+	if details.AbortReason != AbortTimeout || details.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("details = %+v, want a timeout", details)
+	}
+}
+
+func TestTimeoutResponds(t *testing.T) {
+	// Responses written in time are copied, with their headers
+	e := Endpoint{
+		Method: http.MethodGet,
+		Path:   "/",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Test", "yes")
+			Respond(w, r, http.StatusCreated, ErrorBody{Msg: "ok"})
+		}),
+		Timeout: time.Second,
+	}
+
+	w := handleTest(httptest.NewRequest(http.MethodGet, "/", nil), e)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Test") != "yes" || w.Body.String() != `{"msg":"ok"}` {
+		t.Errorf("response = %d %v %s", w.Code, w.Header(), w.Body)
+	}
+}
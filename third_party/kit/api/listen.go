@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Listen returns a listener on the given address, which is one of:
+//
+//	host:port            a TCP address, i.e. ":8080"
+//	unix:/path/to/sock   a Unix domain socket, created with the given mode
+//	systemd              the first listener passed by systemd socket activation
+//	systemd:name         the listener passed by systemd with the given name, or index
+//
+// A stale Unix socket left by a previous process is removed before listening.
+func Listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"), socketMode)
+	case addr == "systemd":
+		return systemdListener("0")
+	case strings.HasPrefix(addr, "systemd:"):
+		return systemdListener(strings.TrimPrefix(addr, "systemd:"))
+	}
+
+	if addr == "" {
+		addr = ":http"
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve serves s on l, as ServeTLS does if s has a TLS config, or as Serve
+// does otherwise. If s serves one of our servers with a connection limit, the
+// limit is applied to l.
+func serve(s *http.Server, l net.Listener) error {
+	if srv, ok := s.Handler.(*server); ok && srv.conns != nil {
+		l = srv.conns.limit(l, s.TLSConfig)
+	}
+
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
+// listenUnix listens on a Unix domain socket at path, with the given mode.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// Remove the socket of a previous process, but never anything else
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// The first file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdFirstFD = 3
+
+// systemdListeners holds the listeners passed by systemd, which can only be
+// taken from the environment once.
+var systemdListeners struct {
+	once    sync.Once
+	err     error
+	byIndex []net.Listener
+	byName  map[string]net.Listener
+}
+
+// systemdListener returns the listener passed by systemd socket activation
+// with the given name, as set by FileDescriptorName=, or index.
+func systemdListener(name string) (net.Listener, error) {
+	sl := &systemdListeners
+	sl.once.Do(func() {
+		sl.byIndex, sl.byName, sl.err = takeSystemdListeners()
+	})
+	if sl.err != nil {
+		return nil, sl.err
+	}
+
+	if l, ok := sl.byName[name]; ok {
+		return l, nil
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(sl.byIndex) {
+		return sl.byIndex[i], nil
+	}
+	return nil, fmt.Errorf("listen systemd: no listener %q was passed", name)
+}
+
+// takeSystemdListeners returns the listeners passed by systemd, by index and by
+// name, removing them from the environment so child processes don't inherit
+// them.
+func takeSystemdListeners() ([]net.Listener, map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// The listeners are only for us if we are the process systemd started
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, fmt.Errorf("listen systemd: no listeners were passed")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, fmt.Errorf("listen systemd: no listeners were passed")
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	byIndex := make([]net.Listener, 0, n)
+	byName := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := systemdFirstFD + i
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// The listener has its own copy of the descriptor, that isn't inherited
+		// by child processes
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("listen systemd: fd %d: %w", fd, err)
+		}
+
+		byIndex = append(byIndex, l)
+		if i < len(names) {
+			byName[names[i]] = l
+		}
+	}
+
+	return byIndex, byName, nil
+}
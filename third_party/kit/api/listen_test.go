@@ -0,0 +1,131 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	l, err := Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", fi.Mode().Perm(), err)
+	}
+
+	// Serve over the socket
+	s := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	go s.Serve(l)
+	defer s.Close()
+
+	if got := getStatus(t, unixClient(path), "/"); got != http.StatusTeapot {
+		t.Errorf("status = %d, want %d", got, http.StatusTeapot)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	// Leave a socket behind, as a process that didn't shut down cleanly would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("stale socket wasn't left behind: %v", err)
+	}
+
+	l, err := Listen("unix:"+path, 0660)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	l.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "api.sock", "not a socket")
+
+	if l, err := Listen("unix:"+path, 0660); err == nil {
+		l.Close()
+		t.Fatal("listened over a file that isn't a socket")
+	}
+
+	// The file is left alone
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "not a socket" {
+		t.Errorf("file = %q, %v, want it unchanged", b, err)
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	l, err := Listen("127.0.0.1:0", 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Addr().Network() != "tcp" {
+		t.Errorf("network = %s, want tcp", l.Addr().Network())
+	}
+}
+
+func TestTakeSystemdListenersNonePassed(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "unset"},
+		{name: "other process", env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}},
+		{name: "no fds", env: map[string]string{"LISTEN_PID": "self", "LISTEN_FDS": "0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				if v == "self" {
+					v = strconv.Itoa(os.Getpid())
+				}
+				os.Setenv(k, v)
+			}
+
+			_, _, err := takeSystemdListeners()
+			if err == nil || !strings.Contains(err.Error(), "no listeners were passed") {
+				t.Errorf("err = %v, want no listeners were passed", err)
+			}
+
+			// The environment is cleared, so child processes don't inherit it
+			for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				if v, ok := os.LookupEnv(k); ok {
+					t.Errorf("%s = %q, want it unset", k, v)
+				}
+			}
+		})
+	}
+}
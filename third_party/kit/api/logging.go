@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blendle/zapdriver"
+	"go.uber.org/zap"
+)
+
+// serverLogger is the logger of the server handling a request, stored in the
+// request context.
+type serverLogger struct {
+	logger *zap.SugaredLogger
+	// The Google Cloud project traces are recorded in, used to correlate logs
+	// with traces. Empty if not known.
+	traceProject string
+}
+
+// Logger returns a logger for use while handling a request. Every line logged
+// includes the request's details and trace context, so it can be correlated
+// with the request. If ctx does not belong to a request handled by a server
+// from this package, the global zap logger is returned.
+func Logger(ctx context.Context) *zap.SugaredLogger {
+	sl, ok := ctx.Value(keyLogger).(serverLogger)
+	if !ok {
+		return zap.S()
+	}
+
+	d, ok := ctx.Value(KeyDetails).(*Details)
+	if !ok {
+		return sl.logger
+	}
+
+	return sl.logger.With(detailFields(ctx, d)...)
+}
+
+// detailFields returns the fields identifying the request with the given
+// details, to be added to log lines about it.
+func detailFields(ctx context.Context, d *Details) []interface{} {
+	kv := []interface{}{
+		"request_id", d.RequestID,
+		"method", d.Method,
+		"path", d.RequestPath,
+	}
+
+	if d.Principal != "" {
+		kv = append(kv, "principal", d.Principal)
+	}
+
+	// Add the trace context if we know where traces are recorded
+	if sl, ok := ctx.Value(keyLogger).(serverLogger); ok && sl.traceProject != "" && d.TraceID != "" {
+		for _, f := range zapdriver.TraceContext(d.TraceID, d.SpanID, d.TraceSampled, sl.traceProject) {
+			kv = append(kv, f)
+		}
+	}
+
+	return kv
+}
+
+// LogMW returns a middleware that implements request + response detail logging.
+// The middleware will log upon response.
+func LogMW(logger *zap.SugaredLogger) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				// Retrieve detail state of this request
+				d := getDetails(r)
+				if d == nil || d.SkipLog {
+					// There's nothing more to do if we can't find the details, or
+					// they say not to log.
+					return
+				}
+
+				kv := append(detailFields(r.Context(), d),
+					"status", d.StatusCode,
+					"duration", time.Since(d.Now),
+				)
+
+				// Say why the request was aborted, if it was
+				if d.AbortReason != "" {
+					kv = append(kv, "reason", d.AbortReason)
+				}
+
+				// Say how many requests before this one weren't logged
+				if d.LogDropped > 0 {
+					kv = append(kv, "dropped", d.LogDropped)
+				}
+
+				logger.Infow("request", kv...)
+			}()
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// AccessLogMW returns a middleware that logs requests as Google Cloud Logging
+// access logs. Each log line holds a zapdriver.HTTPPayload, which Cloud Logging
+// renders natively, and is labelled with the route and given API version.
+// Server errors are logged at error level, client errors at warn level, and
+// everything else at info level.
+//
+// The logger should be built with zapdriver, whose core gathers the labels
+// into the "logging.googleapis.com/labels" field.
+func AccessLogMW(logger *zap.SugaredLogger, apiVersion string) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				// Retrieve detail state of this request
+				d := getDetails(r)
+				if d == nil || d.SkipLog {
+					// There's nothing more to do if we can't find the details, or
+					// they say not to log.
+					return
+				}
+
+				kv := append(detailFields(r.Context(), d),
+					zapdriver.HTTP(httpPayload(r, d)),
+					zapdriver.Label("route", d.RequestPath),
+					zapdriver.Label("api_version", apiVersion),
+				)
+
+				// Say why the request was aborted, if it was
+				if d.AbortReason != "" {
+					kv = append(kv, "reason", d.AbortReason)
+				}
+
+				// Say how many requests before this one weren't logged
+				if d.LogDropped > 0 {
+					kv = append(kv, "dropped", d.LogDropped)
+				}
+
+				switch {
+				case d.StatusCode >= 500:
+					logger.Errorw("request", kv...)
+				case d.StatusCode >= 400:
+					logger.Warnw("request", kv...)
+				default:
+					logger.Infow("request", kv...)
+				}
+			}()
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// httpPayload returns the Cloud Logging description of a request.
+func httpPayload(r *http.Request, d *Details) *zapdriver.HTTPPayload {
+	p := zapdriver.HTTPPayload{
+		RequestMethod: r.Method,
+		RequestURL:    r.URL.String(),
+		RequestSize:   strconv.FormatInt(d.RequestSize, 10),
+		Status:        d.StatusCode,
+		ResponseSize:  strconv.FormatInt(d.ResponseSize, 10),
+		UserAgent:     r.UserAgent(),
+		RemoteIP:      hostOnly(r.RemoteAddr),
+		Referer:       r.Referer(),
+		Latency:       fmt.Sprintf("%.9fs", time.Since(d.Now).Seconds()),
+		Protocol:      r.Proto,
+	}
+
+	// The address the request was received on, if the server recorded it.
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		p.ServerIP = hostOnly(addr.String())
+	}
+
+	return &p
+}
+
+// hostOnly returns the host of a "host:port" address, or the address itself
+// if it has no port.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
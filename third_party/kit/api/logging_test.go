@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// statusEndpoint responds with the status given by its path.
+var statusEndpoint = Endpoint{
+	Method: http.MethodGet,
+	Path:   "/status/:code",
+	Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status/404":
+			RespondError(w, r, http.StatusNotFound)
+		case "/status/500":
+			RespondError(w, r, http.StatusInternalServerError)
+		default:
+			Respond(w, r, http.StatusOK, "ok")
+		}
+	}),
+}
+
+// handleLogs serves requests for the given paths by a server logging with
+// the given options, returning the entries logged.
+func handleLogs(opts ServerOptions, paths ...string) []logEntry {
+	var tl testLog
+	s := newServer(tl.logger(), testAPI{statusEndpoint}, []Middleware{opts.logMW(tl.logger())})
+	for _, path := range paths {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("User-Agent", "test")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	return tl.entries()
+}
+
+func TestLogMW(t *testing.T) {
+	entries := handleLogs(ServerOptions{}, "/status/200", "/status/404", "/status/500")
+	if len(entries) != 3 {
+		t.Fatalf("logged %d entries, want 3", len(entries))
+	}
+	for _, e := range entries {
+		if e.Level != "info" || e.Msg != "request" || e.HTTPRequest != nil {
+			t.Errorf("entry = %+v, want an info request log", e)
+		}
+	}
+}
+
+func TestAccessLogMW(t *testing.T) {
+	entries := handleLogs(ServerOptions{AccessLog: true, APIVersion: "v1"}, "/status/200", "/status/404", "/status/500")
+	if len(entries) != 3 {
+		t.Fatalf("logged %d entries, want 3", len(entries))
+	}
+
+	// Entries are logged at a level chosen by their status
+	for i, want := range []struct {
+		level  string
+		status int
+	}{{"info", 200}, {"warn", 404}, {"error", 500}} {
+		e := entries[i]
+		if e.Level != want.level || e.Msg != "request" {
+			t.Errorf("entry %d = %s %q, want %s request", i, e.Level, e.Msg, want.level)
+		}
+		if e.Route != "/status/:code" {
+			t.Errorf("entry %d route = %q, want /status/:code", i, e.Route)
+		}
+
+		p := e.HTTPRequest
+		if p == nil {
+			t.Fatalf("entry %d has no HTTP payload", i)
+		}
+		if p.Status != want.status || p.RequestMethod != http.MethodGet || p.UserAgent != "test" || p.RemoteIP != "192.0.2.1" || p.Protocol != "HTTP/1.1" {
+			t.Errorf("entry %d payload = %+v", i, p)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	for _, project := range []string{"", "my-project"} {
+		var tl testLog
+		s := newServer(tl.logger(), testAPI{{
+			Method: http.MethodGet,
+			Path:   "/log",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Logger(r.Context()).Info("handling")
+			}),
+		}}, nil)
+		s.traceProject = project
+
+		r := httptest.NewRequest(http.MethodGet, "/log", nil)
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		entries := tl.entries()
+		if len(entries) != 1 || entries[0].Msg != "handling" || entries[0].RequestID == "" {
+			t.Fatalf("project %q: entries = %+v", project, entries)
+		}
+
+		// Logs are only correlated with traces in a known project
+		want := ""
+		if project != "" {
+			want = "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736"
+		}
+		if got := entries[0].Trace; got != want {
+			t.Errorf("project %q: trace = %q, want %q", project, got, want)
+		}
+	}
+}
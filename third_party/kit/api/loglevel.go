@@ -0,0 +1,413 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blendle/zapdriver"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewLogger returns a logger that logs at the given level, i.e. "info", in the
+// given format. The format is one of "json", "console", or "gcp" for Google
+// Cloud Logging. The returned LogLevels can be used to change the level of the
+// logger, and of any loggers named from it, at runtime.
+func NewLogger(level, format string) (*zap.SugaredLogger, *LogLevels, error) {
+	var base zapcore.Level
+	if err := base.Set(level); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	var cfg zap.Config
+	var opts []zap.Option
+	switch format {
+	case "json":
+		cfg = zap.NewProductionConfig()
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+	case "gcp":
+		cfg = zapdriver.NewProductionConfig()
+		opts = append(opts, zapdriver.WrapCore())
+	default:
+		return nil, nil, fmt.Errorf("invalid log format: %q", format)
+	}
+
+	// Levels are decided by our own core, so let everything through the one
+	// zap builds.
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+
+	levels := LogLevels{
+		base:      zap.NewAtomicLevelAt(base),
+		overrides: make(map[string]*levelOverride),
+	}
+	levels.named.Store(map[string]zapcore.Level{})
+
+	// Audit events are logged whatever the level, so they bypass our core.
+	opts = append(opts, zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		levels.audit = zap.New(c).Sugar().Named("audit")
+		return &levelCore{Core: c, levels: &levels}
+	}))
+
+	logger, err := cfg.Build(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return logger.Sugar(), &levels, nil
+}
+
+// LogLevels controls the levels of a logger built by NewLogger, and of the
+// loggers named from it, at runtime. Named loggers without a level of their own
+// use that of their closest named parent, or the base level.
+type LogLevels struct {
+	base zap.AtomicLevel
+
+	// named holds a map[string]zapcore.Level of the level of each named
+	// logger. It is replaced, not modified, on every change so that it can be
+	// read without locking.
+	named atomic.Value
+
+	// mu guards changes to levels, and overrides.
+	mu        sync.Mutex
+	overrides map[string]*levelOverride
+
+	// audit logs changes to levels, whatever the level.
+	audit *zap.SugaredLogger
+}
+
+// levelOverride is a time-boxed level of a logger, which reverts once its
+// timer fires.
+type levelOverride struct {
+	timer    *time.Timer
+	revertTo *zapcore.Level
+	until    time.Time
+}
+
+// LoggerLevel is the level of a logger, as reported by LogLevels.
+type LoggerLevel struct {
+	// The name of the logger, empty for the base logger.
+	Logger string `json:"logger"`
+	// The level of the logger.
+	Level string `json:"level"`
+	// When the level reverts, if it is time-boxed.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Levels returns the level of the base logger, followed by those of any named
+// loggers with their own level, in order of name.
+func (l *LogLevels) Levels() []LoggerLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	named := l.named.Load().(map[string]zapcore.Level)
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	levels := []LoggerLevel{l.describe("", l.base.Level())}
+	for _, name := range names {
+		levels = append(levels, l.describe(name, named[name]))
+	}
+	return levels
+}
+
+// describe returns the LoggerLevel of the named logger. l.mu must be held.
+func (l *LogLevels) describe(name string, lvl zapcore.Level) LoggerLevel {
+	ll := LoggerLevel{Logger: name, Level: lvl.String()}
+	if o, ok := l.overrides[name]; ok {
+		until := o.until
+		ll.Until = &until
+	}
+	return ll
+}
+
+// SetLevel sets the level of the named logger, or of the base logger if name is
+// empty. If d is positive, the level reverts to its previous value after d.
+// The change is logged as an audit event, with the details of the request ctx
+// belongs to, if any.
+func (l *LogLevels) SetLevel(ctx context.Context, name string, lvl zapcore.Level, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := l.current(name)
+
+	kv := []interface{}{"target_logger", name, "from", levelString(from), "to", lvl.String()}
+	if d > 0 {
+		kv = append(kv, "revert_after", d)
+	}
+	l.auditw(ctx, "log level changed", kv...)
+
+	// Keep the level we revert to, from before any existing override
+	revertTo := from
+	if o, ok := l.overrides[name]; ok {
+		o.timer.Stop()
+		revertTo = o.revertTo
+		delete(l.overrides, name)
+	}
+
+	l.set(name, &lvl)
+
+	if d > 0 {
+		o := levelOverride{revertTo: revertTo, until: time.Now().Add(d)}
+		o.timer = time.AfterFunc(d, func() {
+			l.revert(name, &o)
+		})
+		l.overrides[name] = &o
+	}
+}
+
+// ResetLevel removes the level of the named logger, so that it uses the level
+// of its parent. The base logger's level can't be removed. The change is logged
+// as an audit event, as with SetLevel.
+func (l *LogLevels) ResetLevel(ctx context.Context, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.auditw(ctx, "log level removed", "target_logger", name, "from", levelString(l.current(name)))
+
+	if o, ok := l.overrides[name]; ok {
+		o.timer.Stop()
+		delete(l.overrides, name)
+	}
+
+	if name != "" {
+		l.set(name, nil)
+	}
+}
+
+// revert reverts the given override, if it is still in place.
+func (l *LogLevels) revert(name string, o *levelOverride) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.overrides[name] != o {
+		// It was replaced or removed, so there is nothing to revert
+		return
+	}
+	delete(l.overrides, name)
+
+	from := l.current(name)
+	l.set(name, o.revertTo)
+
+	l.audit.Infow("log level reverted",
+		"target_logger", name,
+		"from", levelString(from),
+		"to", levelString(l.current(name)),
+	)
+}
+
+// auditw logs an audit event, with the details of the request the given
+// context belongs to, if any.
+func (l *LogLevels) auditw(ctx context.Context, msg string, kv ...interface{}) {
+	if d, ok := ctx.Value(KeyDetails).(*Details); ok {
+		kv = append(detailFields(ctx, d), kv...)
+	}
+	l.audit.Infow(msg, kv...)
+}
+
+// current returns the level of the named logger, or nil if it doesn't have
+// its own level. l.mu must be held.
+func (l *LogLevels) current(name string) *zapcore.Level {
+	if name == "" {
+		lvl := l.base.Level()
+		return &lvl
+	}
+	if lvl, ok := l.named.Load().(map[string]zapcore.Level)[name]; ok {
+		return &lvl
+	}
+	return nil
+}
+
+// set sets the level of the named logger, removing it if lvl is nil. l.mu
+// must be held.
+func (l *LogLevels) set(name string, lvl *zapcore.Level) {
+	if name == "" {
+		if lvl != nil {
+			l.base.SetLevel(*lvl)
+		}
+		return
+	}
+
+	// Copy the levels, so that readers are never affected by the change
+	old := l.named.Load().(map[string]zapcore.Level)
+	named := make(map[string]zapcore.Level, len(old)+1)
+	for k, v := range old {
+		named[k] = v
+	}
+	if lvl != nil {
+		named[name] = *lvl
+	} else {
+		delete(named, name)
+	}
+	l.named.Store(named)
+}
+
+// enabled returns whether the named logger is enabled at the given level.
+func (l *LogLevels) enabled(name string, lvl zapcore.Level) bool {
+	named := l.named.Load().(map[string]zapcore.Level)
+
+	// Find the level of the logger, or its closest parent. Zap separates the
+	// names of child loggers with dots.
+	for name != "" {
+		if min, ok := named[name]; ok {
+			return min.Enabled(lvl)
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+
+	return l.base.Enabled(lvl)
+}
+
+// anyEnabled returns whether any logger is enabled at the given level.
+func (l *LogLevels) anyEnabled(lvl zapcore.Level) bool {
+	if l.base.Enabled(lvl) {
+		return true
+	}
+	for _, min := range l.named.Load().(map[string]zapcore.Level) {
+		if min.Enabled(lvl) {
+			return true
+		}
+	}
+	return false
+}
+
+// levelString returns the name of a level, or "unset" if it is nil.
+func levelString(lvl *zapcore.Level) string {
+	if lvl == nil {
+		return "unset"
+	}
+	return lvl.String()
+}
+
+// levelCore is a zapcore.Core that only writes entries enabled by the level
+// of the logger they were written to.
+type levelCore struct {
+	zapcore.Core
+	levels *LogLevels
+}
+
+// Enabled implements zapcore.LevelEnabler
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.levels.anyEnabled(lvl)
+}
+
+// With implements zapcore.Core
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), levels: c.levels}
+}
+
+// Check implements zapcore.Core
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.enabled(ent.LoggerName, ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// logLevelAPI is an admin API for reading and changing log levels
+type logLevelAPI struct {
+	levels *LogLevels
+	mw     []Middleware
+}
+
+// NewLogLevelAPI returns an admin API for reading and changing the given log
+// levels at runtime. Every endpoint requires requests to be authenticated by
+// the given auth middleware, i.e. TokenAuthMW, which must not be nil, and is
+// then wrapped in any other given middlewares. Every change is logged as an
+// audit event.
+//
+//	GET    /loglevel          lists the levels of all loggers
+//	PUT    /loglevel          sets a level, i.e. {"logger": "db", "level": "debug", "duration": "10m"}
+//	DELETE /loglevel/:logger  removes the level of a named logger
+func NewLogLevelAPI(levels *LogLevels, auth Middleware, mw ...Middleware) API {
+	if auth == nil {
+		panic("api: NewLogLevelAPI requires an auth middleware")
+	}
+	return &logLevelAPI{levels: levels, mw: append([]Middleware{auth}, mw...)}
+}
+
+// Endpoints implements API
+func (a *logLevelAPI) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method:      http.MethodGet,
+			Path:        "/loglevel",
+			Handler:     http.HandlerFunc(a.get),
+			Middlewares: a.mw,
+		},
+		{
+			Method:       http.MethodPut,
+			Path:         "/loglevel",
+			Handler:      http.HandlerFunc(a.put),
+			Middlewares:  a.mw,
+			MaxBodyBytes: 1 << 10,
+		},
+		{
+			Method:      http.MethodDelete,
+			Path:        "/loglevel/:logger",
+			Handler:     http.HandlerFunc(a.delete),
+			Middlewares: a.mw,
+		},
+	}
+}
+
+// get responds with the levels of all loggers
+func (a *logLevelAPI) get(w http.ResponseWriter, r *http.Request) {
+	Respond(w, r, http.StatusOK, a.levels.Levels())
+}
+
+// put sets the level of a logger
+func (a *logLevelAPI) put(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Logger   string `json:"logger"`
+		Level    string `json:"level"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	var lvl zapcore.Level
+	if err := lvl.Set(req.Level); err != nil {
+		RespondError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil || d < 0 {
+			RespondError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+
+	a.levels.SetLevel(r.Context(), req.Logger, lvl, d)
+
+	Respond(w, r, http.StatusOK, a.levels.Levels())
+}
+
+// delete removes the level of a named logger
+func (a *logLevelAPI) delete(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("logger")
+
+	a.levels.ResetLevel(r.Context(), name)
+
+	Respond(w, r, http.StatusOK, a.levels.Levels())
+}
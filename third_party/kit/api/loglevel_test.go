@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// newTestLogLevels returns log levels at info, with audit events recorded to
+// tl.
+func newTestLogLevels(t *testing.T, tl *testLog) *LogLevels {
+	t.Helper()
+	_, levels, err := NewLogger("info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels.audit = tl.logger()
+	return levels
+}
+
+// handleLogLevel handles the given request with the log level API of levels,
+// authenticated by the token "t0k".
+func handleLogLevel(levels *LogLevels, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	api := NewLogLevelAPI(levels, TokenAuthMW(map[string]string{"t0k": "admin"}))
+	return handleTest(r, api.Endpoints()...)
+}
+
+func TestNewLogger(t *testing.T) {
+	for _, format := range []string{"json", "console", "gcp"} {
+		if _, _, err := NewLogger("debug", format); err != nil {
+			t.Errorf("format %q: %v", format, err)
+		}
+	}
+	if _, _, err := NewLogger("loud", "json"); err == nil {
+		t.Error("invalid level succeeded, want error")
+	}
+	if _, _, err := NewLogger("info", "xml"); err == nil {
+		t.Error("invalid format succeeded, want error")
+	}
+}
+
+func TestLogLevelsEnabled(t *testing.T) {
+	var tl testLog
+	levels := newTestLogLevels(t, &tl)
+	ctx := context.Background()
+
+	levels.SetLevel(ctx, "db", zapcore.DebugLevel, 0)
+	levels.SetLevel(ctx, "db.pool", zapcore.ErrorLevel, 0)
+
+	tests := []struct {
+		name string
+		lvl  zapcore.Level
+		want bool
+	}{
+		{name: "", lvl: zapcore.DebugLevel, want: false},
+		{name: "", lvl: zapcore.InfoLevel, want: true},
+		{name: "db", lvl: zapcore.DebugLevel, want: true},
+		{name: "db.query", lvl: zapcore.DebugLevel, want: true},
+		{name: "db.pool", lvl: zapcore.WarnLevel, want: false},
+		{name: "db.pool.conn", lvl: zapcore.ErrorLevel, want: true},
+		{name: "dbx", lvl: zapcore.DebugLevel, want: false},
+	}
+	for _, tt := range tests {
+		if got := levels.enabled(tt.name, tt.lvl); got != tt.want {
+			t.Errorf("enabled(%q, %s) = %t, want %t", tt.name, tt.lvl, got, tt.want)
+		}
+	}
+	if !levels.anyEnabled(zapcore.DebugLevel) {
+		t.Error("debug not enabled by any logger")
+	}
+
+	levels.ResetLevel(ctx, "db")
+	if levels.enabled("db.query", zapcore.DebugLevel) {
+		t.Error("reset logger still at its own level")
+	}
+
+	// Every change is audited
+	if got := len(tl.entries()); got != 3 {
+		t.Errorf("audited %d changes, want 3", got)
+	}
+}
+
+func TestLogLevelsRevert(t *testing.T) {
+	var tl testLog
+	levels := newTestLogLevels(t, &tl)
+	ctx := context.Background()
+
+	levels.SetLevel(ctx, "db", zapcore.WarnLevel, 0)
+	levels.SetLevel(ctx, "db", zapcore.DebugLevel, time.Hour)
+	// Replacing an override keeps the level it reverts to
+	levels.SetLevel(ctx, "db", zapcore.ErrorLevel, 10*time.Millisecond)
+
+	if got := levels.Levels(); len(got) != 2 || got[1].Level != "error" || got[1].Until == nil {
+		t.Fatalf("levels = %+v", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for levels.Levels()[1].Until != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("level wasn't reverted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := levels.Levels()[1].Level; got != "warn" {
+		t.Errorf("reverted to %q, want warn", got)
+	}
+}
+
+func TestLogLevelAPI(t *testing.T) {
+	var tl testLog
+	levels := newTestLogLevels(t, &tl)
+
+	// Requests must be authenticated
+	for _, token := range []string{"", "wrong"} {
+		if w := handleLogLevel(levels, http.MethodGet, "/loglevel", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want %d", token, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if w := handleLogLevel(levels, http.MethodPut, "/loglevel", "", `{"logger": "db", "level": "debug"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if len(levels.Levels()) != 1 {
+		t.Fatal("unauthenticated request changed levels")
+	}
+
+	for _, body := range []string{`{`, `{"level": "loud"}`, `{"level": "debug", "duration": "-1m"}`} {
+		if w := handleLogLevel(levels, http.MethodPut, "/loglevel", "t0k", body); w.Code != http.StatusBadRequest {
+			t.Errorf("body %s: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := handleLogLevel(levels, http.MethodPut, "/loglevel", "t0k", `{"logger": "db", "level": "debug", "duration": "10m"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got []LoggerLevel
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Logger != "db" || got[1].Level != "debug" || got[1].Until == nil {
+		t.Errorf("levels = %+v", got)
+	}
+
+	if w := handleLogLevel(levels, http.MethodDelete, "/loglevel/db", "t0k", ""); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := levels.Levels(); len(got) != 1 {
+		t.Errorf("levels = %+v, want only the base level", got)
+	}
+}
+
+func TestLogLevelAPIRequiresAuth(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewLogLevelAPI without auth didn't panic")
+		}
+	}()
+	NewLogLevelAPI(&LogLevels{}, nil)
+}
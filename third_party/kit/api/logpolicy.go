@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LogPolicy decides which requests are logged by LogMW and AccessLogMW.
+// Its fields are tagged to be parsed by conf, so it can be embedded in the
+// configuration of a service.
+type LogPolicy struct {
+	// The percentage of successful (2XX) requests that are logged. All other
+	// requests are logged. Zero logs no successful requests, so set it to 100,
+	// as conf does by default, to log them all.
+	SampleRate float64 `conf:"default:100,help:percentage of successful requests to log"`
+	// Per route overrides of SampleRate.
+	RouteSampleRates RouteRates `conf:"help:per route percentage of successful requests to log i.e. GET /accounts/:id=1;/version=10"`
+	// Requests slower than this are always logged. Zero means no threshold.
+	SlowThreshold time.Duration `conf:"default:1s,help:requests slower than this are always logged"`
+	// Routes that are never logged, i.e. probes. Routes are given by path, or
+	// by method and path.
+	Exclude []string `conf:"help:routes to never log i.e. /healthz;GET /readyz"`
+}
+
+// RouteRates maps routes to a percentage. Routes are given by path, i.e.
+// "/accounts/:id", or by method and path, i.e. "GET /accounts/:id".
+type RouteRates map[string]float64
+
+// Set implements conf.Setter, parsing rates given as "route=rate" pairs,
+// separated by semi-colons.
+func (rr *RouteRates) Set(value string) error {
+	m := make(RouteRates)
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		// Paths can't contain '=', so split on the last one
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid route rate: %q", pair)
+		}
+		rate, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid route rate: %q: %w", pair, err)
+		}
+		m[strings.TrimSpace(pair[:i])] = rate
+	}
+
+	*rr = m
+	return nil
+}
+
+// String implements fmt.Stringer
+func (rr RouteRates) String() string {
+	pairs := make([]string, 0, len(rr))
+	for route, rate := range rr {
+		pairs = append(pairs, route+"="+strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// LogPolicyMW returns a middleware that applies the given policy to requests,
+// marking those that should not be logged on their Details. The number of
+// requests dropped by sampling is recorded on the next request that is logged.
+// It must run after LogMW or AccessLogMW.
+func LogPolicyMW(p LogPolicy) Middleware {
+	exclude := make(map[string]bool)
+	for _, route := range p.Exclude {
+		exclude[strings.TrimSpace(route)] = true
+	}
+
+	// The number of requests dropped since a request was last logged
+	var dropped int64
+
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				// Retrieve detail state of this request
+				d := getDetails(r)
+				if d == nil {
+					// There's nothing more to do if we can't find the details.
+					return
+				}
+
+				route := d.Method + " " + d.RequestPath
+
+				switch {
+				case exclude[route] || exclude[d.RequestPath]:
+					// Excluded requests are never logged, nor counted as dropped.
+					d.SkipLog = true
+					return
+				case d.StatusCode/100 != 2 || d.AbortReason != "":
+					// Unsuccessful requests are always logged
+				case p.SlowThreshold > 0 && time.Since(d.Now) > p.SlowThreshold:
+					// Slow requests are always logged
+				case rand.Float64()*100 >= p.rate(route, d.RequestPath):
+					d.SkipLog = true
+					atomic.AddInt64(&dropped, 1)
+					return
+				}
+
+				// This request will be logged, so tell it how many weren't
+				d.LogDropped = atomic.SwapInt64(&dropped, 0)
+			}()
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
+
+// rate returns the sample rate of the given route.
+func (p LogPolicy) rate(route, path string) float64 {
+	if rate, ok := p.RouteSampleRates[route]; ok {
+		return rate
+	}
+	if rate, ok := p.RouteSampleRates[path]; ok {
+		return rate
+	}
+	return p.SampleRate
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// handleLogged serves n requests for each of the given paths by a server
+// logging with the given policy, returning the entries logged.
+func handleLogged(p LogPolicy, n int, paths ...string) []logEntry {
+	var tl testLog
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	s := newServer(tl.logger(), testAPI{
+		{Method: http.MethodGet, Path: "/ok", Handler: ok},
+		{Method: http.MethodGet, Path: "/healthz", Handler: ok},
+		{Method: http.MethodGet, Path: "/fail", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			RespondError(w, r, http.StatusInternalServerError)
+		})},
+		{Method: http.MethodGet, Path: "/slow", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+		})},
+	}, []Middleware{LogMW(tl.logger()), LogPolicyMW(p)})
+
+	for i := 0; i < n; i++ {
+		for _, path := range paths {
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+	}
+	return tl.entries()
+}
+
+func TestLogPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy LogPolicy
+		paths  []string
+		want   int
+	}{
+		{name: "zero rate", policy: LogPolicy{}, paths: []string{"/ok"}, want: 0},
+		{name: "zero rate logs errors", policy: LogPolicy{}, paths: []string{"/fail"}, want: 10},
+		{name: "full rate", policy: LogPolicy{SampleRate: 100}, paths: []string{"/ok"}, want: 10},
+		{name: "tiny rate", policy: LogPolicy{SampleRate: 1e-9}, paths: []string{"/ok"}, want: 0},
+		{name: "errors always logged", policy: LogPolicy{SampleRate: 1e-9}, paths: []string{"/fail"}, want: 10},
+		{name: "slow always logged", policy: LogPolicy{SampleRate: 1e-9, SlowThreshold: time.Millisecond}, paths: []string{"/slow"}, want: 10},
+		{name: "route override", policy: LogPolicy{SampleRate: 100, RouteSampleRates: RouteRates{"GET /ok": 0}}, paths: []string{"/ok", "/healthz"}, want: 10},
+		{name: "path override", policy: LogPolicy{SampleRate: 1e-9, RouteSampleRates: RouteRates{"/ok": 100}}, paths: []string{"/ok"}, want: 10},
+		{name: "excluded", policy: LogPolicy{SampleRate: 100, Exclude: []string{"/healthz", "GET /fail"}}, paths: []string{"/ok", "/healthz", "/fail"}, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(handleLogged(tt.policy, 10, tt.paths...)); got != tt.want {
+				t.Errorf("logged %d requests, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogPolicyDropped(t *testing.T) {
+	p := LogPolicy{SampleRate: 100, RouteSampleRates: RouteRates{"/ok": 0}, Exclude: []string{"/healthz"}}
+	entries := handleLogged(p, 3, "/ok", "/healthz", "/fail")
+	if len(entries) != 3 {
+		t.Fatalf("logged %d requests, want 3", len(entries))
+	}
+	// Excluded requests aren't counted as dropped
+	for _, e := range entries {
+		if e.Dropped != 1 {
+			t.Errorf("dropped = %d, want 1", e.Dropped)
+		}
+	}
+}
+
+func TestRouteRatesSet(t *testing.T) {
+	var rr RouteRates
+	if err := rr.Set("GET /accounts/:id=1; /version=10.5;"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 2 || rr["GET /accounts/:id"] != 1 || rr["/version"] != 10.5 {
+		t.Errorf("rates = %v", rr)
+	}
+
+	for _, value := range []string{"/version", "/version=ten"} {
+		if err := rr.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want error", value)
+		}
+	}
+}
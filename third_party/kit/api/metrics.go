@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsMW returns a middleware that implements counting + timing of requests
+// using a Prometheus Histogram
+func MetricsMW() Middleware {
+	return newMetricsMW(prometheus.DefaultRegisterer, nil)
+}
+
+// newMetricsMW returns a middleware like MetricsMW, registering its metrics
+// with the given registerer. The given labels are added to every metric, so
+// that multiple middlewares can share a registerer, i.e. one per listener.
+func newMetricsMW(reg prometheus.Registerer, labels prometheus.Labels) Middleware {
+	// Create Histogram that will observe request latency.
+	// This Histogram will also expose a 'count' metric that can be used
+	// to rate requests.
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "api_http_latency_seconds",
+		Help:        "HTTP Latency distributions",
+		Buckets:     prometheus.DefBuckets,
+		ConstLabels: labels,
+	}, []string{"method", "path", "status"})
+
+	// Create Counter that will count requests that were aborted, because the
+	// client went away or the handler timed out. These are not observed by the
+	// Histogram, as their latency says nothing about the handler.
+	aborted := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "api_http_aborted_total",
+		Help:        "HTTP requests aborted before completion, by reason",
+		ConstLabels: labels,
+	}, []string{"method", "path", "reason"})
+
+	// Register the metrics to be exposed via the Prometheus metrics handler
+	reg.MustRegister(duration, aborted)
+
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				// Retrieve detail state of this request
+				d := getDetails(r)
+				if d == nil {
+					// There's nothing more to do if we can't find the details.
+					return
+				}
+
+				// Count aborted requests separately
+				if d.AbortReason != "" {
+					aborted.WithLabelValues(d.Method, d.RequestPath, d.AbortReason).Inc()
+					return
+				}
+
+				// Calculate the 'group' of the status code, i.e. 2XX, 3XX etc.
+				statusGroup := fmt.Sprintf("%dXX", d.StatusCode/100)
+
+				// Observe latency of request
+				duration.WithLabelValues(d.Method, d.RequestPath, statusGroup).Observe(time.Since(d.Now).Seconds())
+			}()
+			// Call the wrapped handler
+			next.ServeHTTP(w, r)
+		}
+		return h
+	}
+}
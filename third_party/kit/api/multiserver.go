@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Listener defines an API to be served on its own address.
+type Listener struct {
+	// The name of this listener, i.e. "public" or "admin". It is added to
+	// every log line and metric produced for requests to this listener.
+	Name string
+	// The address to listen on, i.e. ":8080", in any form accepted by Listen.
+	// Unix sockets are created with mode 0660.
+	Addr string
+	// The API to serve on this listener
+	API API
+	// Any listener specific middlewares (i.e. authentication). These run after
+	// the default middlewares, and before any endpoint specific middlewares.
+	Middlewares []Middleware
+	// Whether to log requests as Cloud Logging access logs using AccessLogMW,
+	// rather than with LogMW.
+	AccessLog bool
+	// The version of the API, i.e. "v1", used to label access logs.
+	APIVersion string
+	// The Google Cloud project traces are recorded in, used to correlate logs
+	// with traces, see Logger. If empty, logs aren't correlated.
+	TraceProject string
+	// The policy deciding which requests are logged. If nil, all are logged.
+	LogPolicy *LogPolicy
+	// The TLS config to serve with, i.e. from NewTLSConfig. If nil, plain
+	// HTTP is served.
+	TLSConfig *tls.Config
+	// The maximum number of connections open at once. Further connections are
+	// rejected with a 503. Zero means no limit.
+	MaxConns int
+}
+
+// MultiServer serves multiple APIs, each on its own listener. All listeners
+// are started and stopped together.
+type MultiServer struct {
+	logger    *zap.SugaredLogger
+	listeners []string
+	servers   []*http.Server
+}
+
+// NewMultiServer returns a MultiServer for the given listeners. The logger and
+// metrics registerer are shared by all listeners, with each listener's name
+// added to its logs and metrics.
+func NewMultiServer(logger *zap.SugaredLogger, reg prometheus.Registerer, listeners ...Listener) *MultiServer {
+	m := MultiServer{
+		logger: logger,
+	}
+
+	for _, l := range listeners {
+		// Label everything this listener produces with its name
+		llogger := logger.With("listener", l.Name)
+
+		opts := ServerOptions{AccessLog: l.AccessLog, APIVersion: l.APIVersion}
+
+		// Create the listener's server, with default middlewares followed by its own
+		mw := []Middleware{opts.logMW(llogger), newMetricsMW(reg, prometheus.Labels{"listener": l.Name})}
+		if l.LogPolicy != nil {
+			mw = append(mw, LogPolicyMW(*l.LogPolicy))
+		}
+		mw = append(mw, l.Middlewares...)
+		s := newServer(llogger, l.API, mw)
+		s.traceProject = l.TraceProject
+		s.conns = newConnTracker(reg, prometheus.Labels{"listener": l.Name}, l.MaxConns)
+
+		m.listeners = append(m.listeners, l.Name)
+		m.servers = append(m.servers, &http.Server{
+			Addr:        l.Addr,
+			Handler:     s,
+			ConnContext: withConn,
+			ConnState:   s.conns.connState,
+			TLSConfig:   l.TLSConfig,
+		})
+	}
+
+	return &m
+}
+
+// ListenAndServe starts all listeners, and blocks until they have all stopped.
+// If any listener fails, the others are closed and its error is returned.
+// Otherwise, like http.Server, http.ErrServerClosed is returned once the
+// listeners are stopped by Shutdown or Close.
+func (m *MultiServer) ListenAndServe() error {
+	errs := make(chan error, len(m.servers))
+
+	for i, s := range m.servers {
+		go func(name string, s *http.Server) {
+			m.logger.Infow("listener starting", "listener", name, "addr", s.Addr)
+			l, err := Listen(s.Addr, 0660)
+			if err == nil {
+				err = serve(s, l)
+			}
+			if err != http.ErrServerClosed {
+				err = fmt.Errorf("listener %s: %w", name, err)
+			}
+			errs <- err
+		}(m.listeners[i], s)
+	}
+
+	// Wait for every listener to stop, stopping the rest as soon as one fails.
+	err := http.ErrServerClosed
+	for range m.servers {
+		if e := <-errs; e != http.ErrServerClosed && err == http.ErrServerClosed {
+			err = e
+			m.Close()
+		}
+	}
+
+	return err
+}
+
+// Shutdown gracefully shuts down all listeners, as http.Server.Shutdown does.
+// The first error encountered is returned.
+func (m *MultiServer) Shutdown(ctx context.Context) error {
+	return m.each(func(s *http.Server) error {
+		return s.Shutdown(ctx)
+	})
+}
+
+// Close immediately closes all listeners, as http.Server.Close does.
+// The first error encountered is returned.
+func (m *MultiServer) Close() error {
+	return m.each(func(s *http.Server) error {
+		return s.Close()
+	})
+}
+
+// each calls fn concurrently for every server, returning the first error.
+func (m *MultiServer) each(fn func(*http.Server) error) error {
+	errs := make(chan error, len(m.servers))
+	for _, s := range m.servers {
+		go func(s *http.Server) {
+			errs <- fn(s)
+		}(s)
+	}
+
+	var err error
+	for range m.servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
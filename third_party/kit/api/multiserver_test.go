@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unixClient returns a client sending every request to the Unix socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// getStatus returns the status of a GET of path with the given client,
+// retrying until the server is listening.
+func getStatus(t *testing.T, c *http.Client, path string) int {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err := c.Get("http://unix" + path)
+		if err == nil {
+			res.Body.Close()
+			return res.StatusCode
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMultiServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tl testLog
+	reg := prometheus.NewRegistry()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Respond(w, r, http.StatusOK, "ok")
+	})
+	deny := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Respond(w, r, http.StatusUnauthorized, nil)
+		})
+	}
+	public, admin := filepath.Join(dir, "public.sock"), filepath.Join(dir, "admin.sock")
+	m := NewMultiServer(tl.logger(), reg,
+		Listener{
+			Name: "public",
+			Addr: "unix:" + public,
+			API:  testAPI{{Method: http.MethodGet, Path: "/accounts", Handler: ok}},
+		},
+		Listener{
+			Name:        "admin",
+			Addr:        "unix:" + admin,
+			API:         testAPI{{Method: http.MethodGet, Path: "/metrics", Handler: ok}},
+			Middlewares: []Middleware{deny},
+		},
+	)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.ListenAndServe()
+	}()
+
+	// Each listener serves its own API, with its own middleware
+	pc, ac := unixClient(public), unixClient(admin)
+	if got := getStatus(t, pc, "/accounts"); got != http.StatusOK {
+		t.Errorf("public /accounts status = %d, want %d", got, http.StatusOK)
+	}
+	if got := getStatus(t, pc, "/metrics"); got != http.StatusNotFound {
+		t.Errorf("public /metrics status = %d, want %d", got, http.StatusNotFound)
+	}
+	if got := getStatus(t, ac, "/metrics"); got != http.StatusUnauthorized {
+		t.Errorf("admin /metrics status = %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	// Unix sockets are created with mode 0660
+	if fi, err := os.Stat(public); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, %v, want 0660", fi.Mode().Perm(), err)
+	}
+
+	// Metrics are labelled with the listener
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := make(map[string]bool)
+	for _, mf := range mfs {
+		if mf.GetName() != "api_http_latency_seconds" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "listener" {
+					listeners[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	if !listeners["public"] || !listeners["admin"] {
+		t.Errorf("latency measured for listeners %v, want public and admin", listeners)
+	}
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != http.ErrServerClosed {
+			t.Errorf("ListenAndServe() = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe() didn't return after Shutdown")
+	}
+}
+
+func TestMultiServerListenerFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tl testLog
+	m := NewMultiServer(tl.logger(), prometheus.NewRegistry(),
+		Listener{Name: "public", Addr: "unix:" + filepath.Join(dir, "public.sock"), API: testAPI{}},
+		Listener{Name: "admin", Addr: "unix:" + filepath.Join(dir, "missing", "admin.sock"), API: testAPI{}},
+	)
+
+	// The failure of one listener stops the others
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		if err == nil || !strings.HasPrefix(err.Error(), "listener admin:") {
+			t.Errorf("ListenAndServe() = %v, want the admin listener's error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe() didn't return after a listener failed")
+	}
+}
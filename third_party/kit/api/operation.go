@@ -0,0 +1,431 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/segmentio/ksuid"
+	"go.uber.org/zap"
+)
+
+// OperationStatus is the status of an operation.
+type OperationStatus string
+
+// The statuses of operations
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Done returns whether an operation with the status has finished.
+func (s OperationStatus) Done() bool {
+	return s == OperationSucceeded || s == OperationFailed || s == OperationCancelled
+}
+
+// ErrOperationNotFound is returned by an OperationStore for operations it
+// doesn't have.
+var ErrOperationNotFound = errors.New("operation not found")
+
+// ErrOperationConflict is returned by an OperationStore for updates to
+// operations that have been updated since they were read.
+var ErrOperationConflict = errors.New("operation updated concurrently")
+
+// Operation is a long-running operation, started by a request that was
+// accepted with a 202.
+type Operation struct {
+	// The ID of the operation, a KSUID.
+	ID     string          `json:"id"`
+	Status OperationStatus `json:"status"`
+	// How much of the operation is done, from 0 to 1.
+	Progress float64 `json:"progress"`
+	// The result of a successful operation.
+	Result json.RawMessage `json:"result,omitempty"`
+	// The error of a failed operation.
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// The number of times the operation has been updated, so updates can be
+	// made conditionally, see OperationStore.
+	Version int64 `json:"-"`
+}
+
+// OperationStore stores operations, so their status can be reported.
+type OperationStore interface {
+	// Create stores a new operation.
+	Create(ctx context.Context, op Operation) error
+	// Get returns the operation with the given ID, or ErrOperationNotFound.
+	Get(ctx context.Context, id string) (Operation, error)
+	// Update stores the new state of an existing operation, with its Version
+	// incremented, if its Version is that of the stored operation. Otherwise
+	// the operation has been updated since it was read, and
+	// ErrOperationConflict is returned.
+	Update(ctx context.Context, op Operation) error
+}
+
+// OperationFunc does the work of an operation. It should report its progress,
+// from 0 to 1, as it goes, and stop when ctx is done, as it is if the
+// operation is cancelled. Progress is stored at most once a second. The result
+// it returns is encoded as JSON.
+type OperationFunc func(ctx context.Context, progress func(float64)) (interface{}, error)
+
+// Operations runs long-running operations, and is an API reporting their
+// status on GET /operations/:id, and cancelling them on DELETE
+// /operations/:id.
+type Operations struct {
+	store  OperationStore
+	logger *zap.SugaredLogger
+
+	// How often progress is stored
+	progressInterval time.Duration
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewOperations returns Operations storing operations in the given store. The
+// returned Operations should be served, so clients can follow the operations
+// they start.
+func NewOperations(store OperationStore, logger *zap.SugaredLogger) *Operations {
+	return &Operations{
+		store:            store,
+		logger:           logger,
+		progressInterval: time.Second,
+		cancels:          make(map[string]context.CancelFunc),
+	}
+}
+
+// Start starts an operation doing the given work in the background, and
+// responds to the request that started it with a 202, with the Location of the
+// operation, and the operation as the body.
+func (o *Operations) Start(w http.ResponseWriter, r *http.Request, work OperationFunc) {
+	now := time.Now().UTC()
+	op := Operation{
+		ID:        ksuid.New().String(),
+		Status:    OperationPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := o.store.Create(r.Context(), op); err != nil {
+		Logger(r.Context()).Errorw("operation could not be created", "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// The work outlives the request, but keeps its logger
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), keyLogger, r.Context().Value(keyLogger)))
+	o.mu.Lock()
+	o.cancels[op.ID] = cancel
+	o.mu.Unlock()
+
+	o.wg.Add(1)
+	go o.run(ctx, op, work)
+
+	w.Header().Set("Location", "/operations/"+op.ID)
+	Respond(w, r, http.StatusAccepted, op)
+}
+
+// run does the work of an operation, storing its progress and outcome.
+func (o *Operations) run(ctx context.Context, op Operation, work OperationFunc) {
+	defer o.wg.Done()
+	defer func() {
+		o.mu.Lock()
+		o.cancels[op.ID]()
+		delete(o.cancels, op.ID)
+		o.mu.Unlock()
+	}()
+
+	var mu sync.Mutex
+	update := func(fn func(*Operation)) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if op.Status.Done() {
+			return
+		}
+
+		next := op
+		for {
+			fn(&next)
+			next.UpdatedAt = time.Now().UTC()
+			err := o.store.Update(context.Background(), next)
+			if err == nil {
+				next.Version++
+				op = next
+				return
+			}
+			if err != ErrOperationConflict {
+				o.logger.Errorw("operation could not be updated", "operation", op.ID, "error", err)
+				return
+			}
+
+			// The operation was updated elsewhere, i.e. cancelled by a request
+			// to this or another instance sharing the store, in which case it
+			// stays cancelled
+			if next, err = o.store.Get(context.Background(), op.ID); err != nil {
+				o.logger.Errorw("operation could not be read", "operation", op.ID, "error", err)
+				return
+			}
+			if next.Status.Done() {
+				op = next
+				o.cancel(op.ID)
+				return
+			}
+		}
+	}
+
+	update(func(op *Operation) { op.Status = OperationRunning })
+
+	// Progress may be reported often, so is only stored every progressInterval
+	var (
+		pmu    sync.Mutex
+		stored time.Time
+	)
+	progress := func(p float64) {
+		pmu.Lock()
+		if time.Since(stored) < o.progressInterval {
+			pmu.Unlock()
+			return
+		}
+		stored = time.Now()
+		pmu.Unlock()
+
+		update(func(op *Operation) { op.Progress = p })
+	}
+
+	result, err := o.work(ctx, op.ID, work, progress)
+
+	if err != nil {
+		update(func(op *Operation) {
+			op.Status = OperationFailed
+			op.Error = err.Error()
+		})
+		if op.Status == OperationFailed && err != errOperationPanicked {
+			o.logger.Warnw("operation failed", "operation", op.ID, "error", err)
+		}
+		return
+	}
+
+	var b []byte
+	if result != nil {
+		if b, err = json.Marshal(result); err != nil {
+			o.logger.Errorw("operation result could not be encoded", "operation", op.ID, "error", err)
+			update(func(op *Operation) {
+				op.Status = OperationFailed
+				op.Error = "result could not be encoded"
+			})
+			return
+		}
+	}
+	update(func(op *Operation) {
+		op.Status = OperationSucceeded
+		op.Progress = 1
+		op.Result = b
+	})
+}
+
+// errOperationPanicked is the error of operations whose work panicked. The
+// panic itself is logged, rather than responded with.
+var errOperationPanicked = errors.New("internal error")
+
+// work does the work of the operation with the given ID, recovering if it
+// panics, so the operation fails rather than the process.
+func (o *Operations) work(ctx context.Context, id string, work OperationFunc, progress func(float64)) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			o.logger.Errorw("operation panicked", "operation", id, "panic", p, "stack", string(debug.Stack()))
+			result, err = nil, errOperationPanicked
+		}
+	}()
+	return work(ctx, progress)
+}
+
+// cancel cancels the work of the operation with the given ID, if it is running
+// here.
+func (o *Operations) cancel(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if cancel, ok := o.cancels[id]; ok {
+		cancel()
+	}
+}
+
+// Shutdown waits for running operations to finish, until ctx is done, when it
+// cancels those still running and returns ctx's error. Operations cancelled
+// by shutdown are failed.
+func (o *Operations) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	o.mu.Lock()
+	for _, cancel := range o.cancels {
+		cancel()
+	}
+	o.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// Endpoints implements API
+func (o *Operations) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method:  http.MethodGet,
+			Path:    "/operations/:id",
+			Handler: http.HandlerFunc(o.handleGet),
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/operations/:id",
+			Handler: http.HandlerFunc(o.handleDelete),
+		},
+	}
+}
+
+// handleGet responds with the operation.
+func (o *Operations) handleGet(w http.ResponseWriter, r *http.Request) {
+	op, ok := o.get(w, r)
+	if !ok {
+		return
+	}
+	Respond(w, r, http.StatusOK, op)
+}
+
+// handleDelete cancels the operation, if it hasn't finished, responding with
+// it. Operations that have finished can't be cancelled, and are responded to
+// with a 409.
+func (o *Operations) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var op Operation
+	for {
+		var ok bool
+		if op, ok = o.get(w, r); !ok {
+			return
+		}
+		if op.Status.Done() {
+			Respond(w, r, http.StatusConflict, ErrorBody{Msg: "Operation has already finished"})
+			return
+		}
+
+		op.Status = OperationCancelled
+		op.UpdatedAt = time.Now().UTC()
+		err := o.store.Update(r.Context(), op)
+		if err == ErrOperationConflict {
+			// The operation was updated since it was read, and may have
+			// finished, so read it again
+			continue
+		}
+		if err != nil {
+			Logger(r.Context()).Errorw("operation could not be cancelled", "operation", op.ID, "error", err)
+			RespondError(w, r, http.StatusInternalServerError)
+			return
+		}
+		op.Version++
+		break
+	}
+
+	// If the work isn't running here, it stops the next time its progress is
+	// stored
+	o.cancel(op.ID)
+
+	Respond(w, r, http.StatusOK, op)
+}
+
+// get returns the operation a request is for, responding with a 404 if there
+// isn't one.
+func (o *Operations) get(w http.ResponseWriter, r *http.Request) (Operation, bool) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	op, err := o.store.Get(r.Context(), id)
+	if err == ErrOperationNotFound {
+		RespondError(w, r, http.StatusNotFound)
+		return Operation{}, false
+	}
+	if err != nil {
+		Logger(r.Context()).Errorw("operation could not be read", "operation", id, "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return Operation{}, false
+	}
+	return op, true
+}
+
+// MemoryOperationStore is an OperationStore that holds operations in memory.
+// Finished operations are forgotten once they are older than the retention.
+type MemoryOperationStore struct {
+	retention time.Duration
+
+	mu  sync.Mutex
+	ops map[string]Operation
+}
+
+// NewMemoryOperationStore returns a MemoryOperationStore keeping finished
+// operations for the given duration. Zero means they are kept forever.
+func NewMemoryOperationStore(retention time.Duration) *MemoryOperationStore {
+	return &MemoryOperationStore{
+		retention: retention,
+		ops:       make(map[string]Operation),
+	}
+}
+
+// Create implements OperationStore
+func (s *MemoryOperationStore) Create(ctx context.Context, op Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget old operations as new ones are created, so they don't grow forever
+	if s.retention > 0 {
+		for id, old := range s.ops {
+			if old.Status.Done() && time.Since(old.UpdatedAt) > s.retention {
+				delete(s.ops, id)
+			}
+		}
+	}
+
+	s.ops[op.ID] = op
+	return nil
+}
+
+// Get implements OperationStore
+func (s *MemoryOperationStore) Get(ctx context.Context, id string) (Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.ops[id]
+	if !ok {
+		return Operation{}, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+// Update implements OperationStore
+func (s *MemoryOperationStore) Update(ctx context.Context, op Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.ops[op.ID]
+	if !ok {
+		return ErrOperationNotFound
+	}
+	if cur.Version != op.Version {
+		return ErrOperationConflict
+	}
+	op.Version++
+	s.ops[op.ID] = op
+	return nil
+}
@@ -0,0 +1,355 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startOperation starts an operation doing work, returning it as it was
+// responded with.
+func startOperation(t *testing.T, o *Operations, work OperationFunc) Operation {
+	t.Helper()
+	e := Endpoint{
+		Method: http.MethodPost,
+		Path:   "/jobs",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			o.Start(w, r, work)
+		}),
+	}
+	w := handleTest(httptest.NewRequest(http.MethodPost, "/jobs", nil), e)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(w.Body.Bytes(), &op); err != nil {
+		t.Fatal(err)
+	}
+	if loc := w.Header().Get("Location"); loc != "/operations/"+op.ID {
+		t.Errorf("Location = %q, want /operations/%s", loc, op.ID)
+	}
+	return op
+}
+
+// waitFor waits for cond to be true, failing if it isn't within a few seconds.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForOperation waits for the stored operation to have finished,
+// returning it.
+func waitForOperation(t *testing.T, store OperationStore, id string) Operation {
+	t.Helper()
+	var op Operation
+	waitFor(t, "operation "+id, func() bool {
+		var err error
+		op, err = store.Get(context.Background(), id)
+		return err == nil && op.Status.Done()
+	})
+	return op
+}
+
+func TestOperation(t *testing.T) {
+	tests := []struct {
+		name   string
+		work   OperationFunc
+		status OperationStatus
+		result string
+		error  string
+	}{
+		{
+			name: "succeeded",
+			work: func(ctx context.Context, progress func(float64)) (interface{}, error) {
+				progress(0.5)
+				return map[string]int{"count": 2}, nil
+			},
+			status: OperationSucceeded,
+			result: `{"count":2}`,
+		},
+		{
+			name: "failed",
+			work: func(ctx context.Context, progress func(float64)) (interface{}, error) {
+				return nil, errors.New("boom")
+			},
+			status: OperationFailed,
+			error:  "boom",
+		},
+		{
+			name: "panicked",
+			work: func(ctx context.Context, progress func(float64)) (interface{}, error) {
+				panic("boom")
+			},
+			status: OperationFailed,
+			error:  "internal error",
+		},
+		{
+			name: "unencodable",
+			work: func(ctx context.Context, progress func(float64)) (interface{}, error) {
+				return func() {}, nil
+			},
+			status: OperationFailed,
+			error:  "result could not be encoded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log testLog
+			store := NewMemoryOperationStore(0)
+			o := NewOperations(store, log.logger())
+
+			op := startOperation(t, o, tt.work)
+			if op.Status != OperationPending {
+				t.Errorf("status = %s, want %s", op.Status, OperationPending)
+			}
+
+			op = waitForOperation(t, store, op.ID)
+			if op.Status != tt.status || string(op.Result) != tt.result || op.Error != tt.error {
+				t.Errorf("operation = %+v, want %s", op, tt.status)
+			}
+			if op.Status == OperationSucceeded && op.Progress != 1 {
+				t.Errorf("progress = %f, want 1", op.Progress)
+			}
+			if err := o.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+
+			if tt.name == "panicked" {
+				entries := log.entries()
+				if len(entries) != 1 || entries[0].Level != "error" || entries[0].Msg != "operation panicked" {
+					t.Errorf("logged %+v, want the panic", entries)
+				}
+			}
+		})
+	}
+}
+
+// blockingWork is work that runs until it is cancelled, once it has started.
+func blockingWork(started chan<- struct{}) OperationFunc {
+	return func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+}
+
+func TestOperationCancel(t *testing.T) {
+	store := NewMemoryOperationStore(0)
+	o := NewOperations(store, zap.NewNop().Sugar())
+	defer o.Shutdown(context.Background())
+
+	started := make(chan struct{})
+	op := startOperation(t, o, blockingWork(started))
+	<-started
+
+	del := func() *httptest.ResponseRecorder {
+		return handleTest(httptest.NewRequest(http.MethodDelete, "/operations/"+op.ID, nil), o.Endpoints()...)
+	}
+
+	w := del()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if op = waitForOperation(t, store, op.ID); op.Status != OperationCancelled {
+		t.Errorf("status = %s, want %s", op.Status, OperationCancelled)
+	}
+
+	// Finished operations can't be cancelled
+	if w = del(); w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	w = handleTest(httptest.NewRequest(http.MethodGet, "/operations/"+op.ID, nil), o.Endpoints()...)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	w = handleTest(httptest.NewRequest(http.MethodGet, "/operations/missing", nil), o.Endpoints()...)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestOperationShutdown(t *testing.T) {
+	store := NewMemoryOperationStore(0)
+	o := NewOperations(store, zap.NewNop().Sugar())
+
+	started := make(chan struct{})
+	op := startOperation(t, o, blockingWork(started))
+	<-started
+
+	// Operations still running when shutdown times out are cancelled, and fail
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := o.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	op, err := store.Get(context.Background(), op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Status != OperationFailed {
+		t.Errorf("status = %s, want %s", op.Status, OperationFailed)
+	}
+}
+
+func TestMemoryOperationStoreUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryOperationStore(0)
+	if err := store.Create(ctx, Operation{ID: "op", Status: OperationPending}); err != nil {
+		t.Fatal(err)
+	}
+
+	op, _ := store.Get(ctx, "op")
+	stale := op
+	op.Status = OperationRunning
+	if err := store.Update(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	if op, _ = store.Get(ctx, "op"); op.Version != 1 || op.Status != OperationRunning {
+		t.Errorf("operation = %+v, want version 1", op)
+	}
+
+	// Updates to operations that have changed since they were read fail
+	stale.Status = OperationCancelled
+	if err := store.Update(ctx, stale); err != ErrOperationConflict {
+		t.Errorf("Update: %v, want %v", err, ErrOperationConflict)
+	}
+	if err := store.Update(ctx, Operation{ID: "missing"}); err != ErrOperationNotFound {
+		t.Errorf("Update: %v, want %v", err, ErrOperationNotFound)
+	}
+}
+
+// staleStore is an OperationStore that returns the operations as they were
+// when it was created, the first time they are read.
+type staleStore struct {
+	*MemoryOperationStore
+	stale map[string]Operation
+}
+
+// Get implements OperationStore
+func (s *staleStore) Get(ctx context.Context, id string) (Operation, error) {
+	if op, ok := s.stale[id]; ok {
+		delete(s.stale, id)
+		return op, nil
+	}
+	return s.MemoryOperationStore.Get(ctx, id)
+}
+
+func TestOperationCancelFinished(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryOperationStore(0)
+	op := Operation{ID: "op", Status: OperationRunning}
+	mem.Create(ctx, op)
+	store := staleStore{MemoryOperationStore: mem, stale: map[string]Operation{"op": op}}
+
+	// The operation succeeds after the DELETE reads it, but before it is
+	// cancelled
+	succeeded := op
+	succeeded.Status = OperationSucceeded
+	succeeded.Result = []byte(`{"count":2}`)
+	if err := mem.Update(ctx, succeeded); err != nil {
+		t.Fatal(err)
+	}
+
+	o := NewOperations(&store, zap.NewNop().Sugar())
+	w := handleTest(httptest.NewRequest(http.MethodDelete, "/operations/op", nil), o.Endpoints()...)
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if op, _ = mem.Get(ctx, "op"); op.Status != OperationSucceeded || string(op.Result) != `{"count":2}` {
+		t.Errorf("operation = %+v, want it to have succeeded", op)
+	}
+}
+
+func TestOperationCancelElsewhere(t *testing.T) {
+	store := NewMemoryOperationStore(0)
+	o := NewOperations(store, zap.NewNop().Sugar())
+	o.progressInterval = 0
+	defer o.Shutdown(context.Background())
+
+	// The operation is cancelled by another instance, so the work only stops
+	// once it reports its progress
+	cancelled := make(chan struct{})
+	reported := make(chan struct{})
+	op := startOperation(t, o, func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		<-cancelled
+		progress(0.5)
+		close(reported)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	other := NewOperations(store, zap.NewNop().Sugar())
+	waitFor(t, "operation to run", func() bool {
+		op, _ = store.Get(context.Background(), op.ID)
+		return op.Status == OperationRunning
+	})
+	w := handleTest(httptest.NewRequest(http.MethodDelete, "/operations/"+op.ID, nil), other.Endpoints()...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	close(cancelled)
+	<-reported
+
+	if err := o.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if op, _ = store.Get(context.Background(), op.ID); op.Status != OperationCancelled || op.Progress != 0 {
+		t.Errorf("operation = %+v, want it cancelled", op)
+	}
+}
+
+// countingStore is an OperationStore counting its updates.
+type countingStore struct {
+	*MemoryOperationStore
+	mu      sync.Mutex
+	updates int
+}
+
+// Update implements OperationStore
+func (s *countingStore) Update(ctx context.Context, op Operation) error {
+	s.mu.Lock()
+	s.updates++
+	s.mu.Unlock()
+	return s.MemoryOperationStore.Update(ctx, op)
+}
+
+func TestOperationProgress(t *testing.T) {
+	store := countingStore{MemoryOperationStore: NewMemoryOperationStore(0)}
+	o := NewOperations(&store, zap.NewNop().Sugar())
+	o.progressInterval = time.Hour
+
+	op := startOperation(t, o, func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		for i := 0; i < 100; i++ {
+			progress(float64(i) / 100)
+		}
+		return nil, nil
+	})
+	if err := o.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation is stored running, with its first progress, then
+	// succeeded
+	if store.updates != 3 {
+		t.Errorf("stored %d updates, want 3", store.updates)
+	}
+	if op, _ = store.Get(context.Background(), op.ID); op.Status != OperationSucceeded || op.Progress != 1 {
+		t.Errorf("operation = %+v, want it to have succeeded", op)
+	}
+}
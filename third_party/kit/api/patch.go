@@ -0,0 +1,603 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The media types of patches accepted by Patch.
+const (
+	MediaTypeMergePatch = "application/merge-patch+json"
+	MediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// ErrUnsupportedPatch is returned by Patch when the request body isn't a
+// supported patch type.
+var ErrUnsupportedPatch = errors.New("unsupported patch media type")
+
+// Validator is implemented by resources that can check themselves for errors.
+type Validator interface {
+	// Validate returns an error if the resource is invalid.
+	Validate() error
+}
+
+// PatchError is returned by Patch when a patch can't be applied.
+type PatchError struct {
+	// The index of the JSON Patch operation that failed, or -1 if the error
+	// isn't specific to an operation.
+	Index int
+	// The operation, and the path it applied to, if Index isn't -1.
+	Op   string
+	Path string
+	// Whether the patch was invalid, rather than failing against the resource.
+	Invalid bool
+	// Whether a test operation failed.
+	TestFailed bool
+	Err        error
+}
+
+// Error implements error
+func (e *PatchError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("patch failed: %v", e.Err)
+	}
+	return fmt.Sprintf("patch operation %d (%s %s) failed: %v", e.Index, e.Op, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is returned by Patch when the patched resource is invalid.
+type ValidationError struct {
+	Err error
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Patch applies the patch in the request body to v, a pointer to a resource,
+// which is only modified if the patch applies and the result is valid. The
+// patch is a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902), as given
+// by the request's Content-Type. The patch is applied to the JSON encoding of
+// the resource, so paths and fields are named as they are encoded. Fields the
+// resource doesn't have are rejected. If the resource implements Validator, the
+// patched resource is validated.
+//
+// Errors should be responded to with RespondPatchError.
+func Patch(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != MediaTypeMergePatch && mediaType != MediaTypeJSONPatch {
+		return ErrUnsupportedPatch
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	// Apply the patch to the resource's JSON encoding
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSON(b)
+	if err != nil {
+		return err
+	}
+
+	if mediaType == MediaTypeMergePatch {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			return &PatchError{Index: -1, Invalid: true, Err: err}
+		}
+		doc = mergePatch(doc, patch)
+	} else {
+		var ops []patchOp
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&ops); err != nil {
+			return &PatchError{Index: -1, Invalid: true, Err: err}
+		}
+		if doc, err = jsonPatch(doc, ops); err != nil {
+			return err
+		}
+	}
+
+	// Decode the result into a copy of the resource, so only v is updated if it
+	// is valid. Fields that are encoded are cleared first, so those that were
+	// removed are reset, while those that aren't, i.e. unexported fields, keep
+	// their values
+	if b, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	patched := reflect.New(reflect.TypeOf(v).Elem())
+	patched.Elem().Set(reflect.ValueOf(v).Elem())
+	clearEncoded(patched.Elem(), doc)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(patched.Interface()); err != nil {
+		return &PatchError{Index: -1, Err: err}
+	}
+
+	if val, ok := patched.Interface().(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return &ValidationError{Err: err}
+		}
+	}
+
+	reflect.ValueOf(v).Elem().Set(patched.Elem())
+	return nil
+}
+
+// jsonUnmarshalerType is the type of json.Unmarshaler
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// clearEncoded zeroes the parts of v that are encoded as JSON, before the
+// patched document doc is decoded into it. Structs that doc still holds as
+// objects are cleared field by field, so their fields that aren't encoded are
+// kept. Structs that v points to are copied first, so the resource v was
+// copied from isn't modified.
+func clearEncoded(v reflect.Value, doc interface{}) {
+	obj, ok := doc.(map[string]interface{})
+	if !ok || v.Kind() != reflect.Struct || reflect.PtrTo(v.Type()).Implements(jsonUnmarshalerType) {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// The fields of embedded structs are encoded as if they were v's
+		if sf.Anonymous && name == "" {
+			if indirectType(sf.Type).Kind() == reflect.Struct {
+				if sf.Type.Kind() == reflect.Ptr {
+					if f.IsNil() {
+						continue
+					}
+					f = copyPtr(f)
+				}
+				clearEncoded(reflect.Indirect(f), obj)
+				continue
+			}
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		sub, ok := obj[name]
+		if !ok {
+			f.Set(reflect.Zero(sf.Type))
+			continue
+		}
+		if sf.Type.Kind() == reflect.Ptr {
+			if f.IsNil() || sf.Type.Elem().Kind() != reflect.Struct {
+				f.Set(reflect.Zero(sf.Type))
+				continue
+			}
+			f = copyPtr(f).Elem()
+		}
+		clearEncoded(f, sub)
+	}
+}
+
+// copyPtr sets the pointer f to a copy of what it points to, returning it.
+func copyPtr(f reflect.Value) reflect.Value {
+	p := reflect.New(f.Type().Elem())
+	p.Elem().Set(f.Elem())
+	f.Set(p)
+	return p
+}
+
+// indirectType returns the type t points to, if it is a pointer, or t.
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// PatchErrorBody is the body of responses to patches that failed.
+type PatchErrorBody struct {
+	Msg string `json:"msg"`
+	// The index of the JSON Patch operation that failed, if any.
+	Index *int `json:"index,omitempty"`
+	// The operation and the path it applied to, if any.
+	Op   string `json:"op,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// RespondPatchError responds to a request whose patch failed, with the error
+// returned by Patch. Unsupported patches are responded to with a 415, invalid
+// patches with a 400, failed test operations with a 409, and patches that
+// can't be applied, or result in an invalid resource, with a 422. The body
+// describes the error, including the index of the failing operation.
+func RespondPatchError(w http.ResponseWriter, r *http.Request, err error) {
+	var pe *PatchError
+	var ve *ValidationError
+	switch {
+	case err == ErrUnsupportedPatch:
+		w.Header().Set("Accept-Patch", MediaTypeMergePatch+", "+MediaTypeJSONPatch)
+		RespondError(w, r, http.StatusUnsupportedMediaType)
+	case errors.Is(err, ErrBodyTooLarge):
+		RespondError(w, r, http.StatusRequestEntityTooLarge)
+	case errors.As(err, &pe):
+		status := http.StatusUnprocessableEntity
+		switch {
+		case pe.Invalid:
+			status = http.StatusBadRequest
+		case pe.TestFailed:
+			status = http.StatusConflict
+		}
+		body := PatchErrorBody{Msg: pe.Err.Error()}
+		if pe.Index >= 0 {
+			index := pe.Index
+			body.Index, body.Op, body.Path = &index, pe.Op, pe.Path
+		}
+		Respond(w, r, status, body)
+	case errors.As(err, &ve):
+		Respond(w, r, http.StatusUnprocessableEntity, ErrorBody{Msg: ve.Error()})
+	default:
+		RespondError(w, r, http.StatusInternalServerError)
+	}
+}
+
+// decodeJSON decodes a JSON value, keeping numbers as they were written.
+func decodeJSON(b []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergePatch applies a JSON Merge Patch to doc, as defined by RFC 7396.
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		// Anything other than an object replaces the document
+		return patch
+	}
+
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
+
+// patchOp is an operation of a JSON Patch
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonPatch applies the operations of a JSON Patch to doc, as defined by RFC
+// 6902. If any operation fails, the error is returned, and the document
+// should be discarded.
+func jsonPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		fail := func(invalid bool, err error) error {
+			pe := PatchError{Index: i, Op: op.Op, Invalid: invalid, Err: err}
+			if op.Path != nil {
+				pe.Path = *op.Path
+			}
+			return &pe
+		}
+
+		if op.Path == nil {
+			return nil, fail(true, errors.New("missing path"))
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, fail(true, err)
+		}
+
+		// The value, for operations that take one
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fail(true, errors.New("missing value"))
+			}
+			if value, err = decodeJSON(op.Value); err != nil {
+				return nil, fail(true, err)
+			}
+		}
+
+		// The path values are taken from, for operations that take one
+		var from []string
+		switch op.Op {
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fail(true, errors.New("missing from"))
+			}
+			if from, err = parsePointer(*op.From); err != nil {
+				return nil, fail(true, err)
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, path); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "move":
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, fail(false, errors.New("can't move a value into itself"))
+			}
+			var moved interface{}
+			if doc, moved, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = pointerGet(doc, from); err == nil {
+				// Copy the value, so later operations don't modify both
+				if copied, err = deepCopyJSON(copied); err == nil {
+					doc, err = pointerAdd(doc, path, copied)
+				}
+			}
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(doc, path); err == nil && !jsonEqual(current, value) {
+				pe := fail(false, errors.New("value does not match")).(*PatchError)
+				pe.TestFailed = true
+				return nil, pe
+			}
+		default:
+			return nil, fail(true, fmt.Errorf("unknown op %q", op.Op))
+		}
+		if err != nil {
+			return nil, fail(false, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// parsePointer parses a JSON Pointer, as defined by RFC 6901, into its tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid path %q", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// pointerGet returns the value at path within doc.
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[t]
+			if !ok {
+				return nil, fmt.Errorf("path not found: %s", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("path not found: %s", t)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at path within doc, returning the new document.
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		i := len(p)
+		if last != "-" {
+			if i, err = arrayIndex(last, len(p)); err != nil {
+				return nil, err
+			}
+		}
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = value
+		return pointerReplace(doc, path[:len(path)-1], p)
+	default:
+		return nil, fmt.Errorf("path not found: %s", last)
+	}
+	return doc, nil
+}
+
+// pointerRemove removes the value at path within doc, returning the new
+// document and the removed value.
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		v, ok := p[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path not found: %s", last)
+		}
+		delete(p, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(p)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := p[i]
+		p = append(p[:i:i], p[i+1:]...)
+		doc, err = pointerReplace(doc, path[:len(path)-1], p)
+		return doc, v, err
+	}
+	return nil, nil, fmt.Errorf("path not found: %s", last)
+}
+
+// pointerReplace replaces the value at path within doc, which must exist,
+// returning the new document. Arrays are replaced, rather than modified in
+// place, as their length changes.
+func pointerReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(p)-1)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = value
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index from a JSON Pointer token, which must be no
+// greater than max.
+func arrayIndex(t string, max int) (int, error) {
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || (len(t) > 1 && t[0] == '0') {
+		return 0, fmt.Errorf("invalid array index: %s", t)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index out of range: %s", t)
+	}
+	return i, nil
+}
+
+// isPrefix returns whether prefix is a prefix of path.
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deepCopyJSON returns a copy of a decoded JSON value.
+func deepCopyJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(b)
+}
+
+// jsonEqual returns whether two decoded JSON values are equal.
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type patchAddress struct {
+	City string `json:"city"`
+	// Not encoded, so not patchable
+	Verified bool `json:"-"`
+}
+
+type patchAccount struct {
+	Name     string            `json:"name"`
+	Currency string            `json:"currency"`
+	Tags     []string          `json:"tags,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Address  patchAddress      `json:"address"`
+	Billing  *patchAddress     `json:"billing,omitempty"`
+	Nickname *string           `json:"nickname,omitempty"`
+	// Not encoded, so not patchable
+	Version int `json:"-"`
+	etag    string
+}
+
+// Validate implements Validator
+func (a *patchAccount) Validate() error {
+	if a.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func newPatchAccount() *patchAccount {
+	nickname := "Annie"
+	return &patchAccount{
+		Nickname: &nickname,
+		Name:     "Ann",
+		Currency: "GBP",
+		Tags:     []string{"a", "b"},
+		Meta:     map[string]string{"x": "1", "y": "2"},
+		Address:  patchAddress{City: "London", Verified: true},
+		Billing:  &patchAddress{City: "Leeds", Verified: true},
+		Version:  7,
+		etag:     `"7"`,
+	}
+}
+
+// patchRequest returns a request with the given patch.
+func patchRequest(mediaType, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPatch, "/accounts/acc_1", strings.NewReader(body))
+	r.Header.Set("Content-Type", mediaType)
+	return r
+}
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		patch     string
+		want      func(a *patchAccount)
+	}{
+		{
+			name:      "merge replace",
+			mediaType: MediaTypeMergePatch,
+			patch:     `{"name":"Bob","nickname":"Bobby","address":{"city":"Paris"}}`,
+			want: func(a *patchAccount) {
+				nickname := "Bobby"
+				a.Name = "Bob"
+				a.Nickname = &nickname
+				a.Address.City = "Paris"
+			},
+		},
+		{
+			name:      "merge null",
+			mediaType: MediaTypeMergePatch,
+			patch:     `{"currency":null,"meta":{"x":null},"billing":null}`,
+			want: func(a *patchAccount) {
+				a.Currency = ""
+				a.Meta = map[string]string{"y": "2"}
+				a.Billing = nil
+			},
+		},
+		{
+			name:      "merge with content type parameters",
+			mediaType: MediaTypeMergePatch + "; charset=utf-8",
+			patch:     `{"tags":["c"]}`,
+			want: func(a *patchAccount) {
+				a.Tags = []string{"c"}
+			},
+		},
+		{
+			name:      "json patch",
+			mediaType: MediaTypeJSONPatch,
+			patch: `[
+				{"op":"test","path":"/name","value":"Ann"},
+				{"op":"replace","path":"/name","value":"Bob"},
+				{"op":"add","path":"/tags/-","value":"c"},
+				{"op":"remove","path":"/tags/0"},
+				{"op":"remove","path":"/meta/x"},
+				{"op":"copy","from":"/address/city","path":"/meta/city"},
+				{"op":"move","from":"/billing/city","path":"/address/city"}
+			]`,
+			want: func(a *patchAccount) {
+				a.Name = "Bob"
+				a.Tags = []string{"b", "c"}
+				a.Meta = map[string]string{"y": "2", "city": "London"}
+				a.Address.City = "Leeds"
+				a.Billing.City = ""
+			},
+		},
+		{
+			name:      "json patch remove",
+			mediaType: MediaTypeJSONPatch,
+			patch:     `[{"op":"remove","path":"/tags"},{"op":"remove","path":"/meta"},{"op":"remove","path":"/billing"}]`,
+			want: func(a *patchAccount) {
+				a.Tags = nil
+				a.Meta = nil
+				a.Billing = nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newPatchAccount()
+			orig := newPatchAccount()
+			billing, nickname := a.Billing, a.Nickname
+
+			if err := Patch(patchRequest(tt.mediaType, tt.patch), a); err != nil {
+				t.Fatalf("Patch: %v", err)
+			}
+
+			want := newPatchAccount()
+			tt.want(want)
+			if !reflect.DeepEqual(a, want) {
+				t.Errorf("patched = %+v, want %+v", a, want)
+			}
+
+			// Fields that aren't encoded are kept, and what the resource pointed
+			// to isn't changed
+			if a.Version != 7 || a.etag != `"7"` || !a.Address.Verified {
+				t.Errorf("fields that aren't encoded were changed: %+v", a)
+			}
+			if a.Billing != nil && !a.Billing.Verified {
+				t.Errorf("fields that aren't encoded were changed: %+v", a.Billing)
+			}
+			if !reflect.DeepEqual(billing, orig.Billing) || *nickname != *orig.Nickname {
+				t.Errorf("original changed to %+v, %s", billing, *nickname)
+			}
+		})
+	}
+}
+
+func TestPatchErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		patch     string
+		status    int
+		body      string
+	}{
+		{
+			name:      "unsupported",
+			mediaType: "application/json",
+			patch:     `{}`,
+			status:    http.StatusUnsupportedMediaType,
+			body:      `{"msg":"Unsupported Media Type"}`,
+		},
+		{
+			name:      "invalid merge patch",
+			mediaType: MediaTypeMergePatch,
+			patch:     `{`,
+			status:    http.StatusBadRequest,
+		},
+		{
+			name:      "unknown op",
+			mediaType: MediaTypeJSONPatch,
+			patch:     `[{"op":"replace","path":"/name","value":"Bob"},{"op":"frob","path":"/name"}]`,
+			status:    http.StatusBadRequest,
+			body:      `{"msg":"unknown op \"frob\"","index":1,"op":"frob","path":"/name"}`,
+		},
+		{
+			name:      "test failed",
+			mediaType: MediaTypeJSONPatch,
+			patch:     `[{"op":"test","path":"/name","value":"Bob"}]`,
+			status:    http.StatusConflict,
+			body:      `{"msg":"value does not match","index":0,"op":"test","path":"/name"}`,
+		},
+		{
+			name:      "missing path",
+			mediaType: MediaTypeJSONPatch,
+			patch:     `[{"op":"remove","path":"/nope"}]`,
+			status:    http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "unknown field",
+			mediaType: MediaTypeMergePatch,
+			patch:     `{"version":8}`,
+			status:    http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "invalid result",
+			mediaType: MediaTypeMergePatch,
+			patch:     `{"name":null}`,
+			status:    http.StatusUnprocessableEntity,
+			body:      `{"msg":"name is required"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newPatchAccount()
+			e := Endpoint{
+				Method: http.MethodPatch,
+				Path:   "/accounts/:id",
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if err := Patch(r, a); err != nil {
+						RespondPatchError(w, r, err)
+						return
+					}
+					Respond(w, r, http.StatusOK, a)
+				}),
+			}
+
+			w := handleTest(patchRequest(tt.mediaType, tt.patch), e)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %s, want %s", w.Body, tt.body)
+			}
+			if tt.status == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Patch") == "" {
+				t.Error("Accept-Patch isn't set")
+			}
+
+			// The resource is only changed by patches that succeed
+			if !reflect.DeepEqual(a, newPatchAccount()) {
+				t.Errorf("resource changed to %+v", a)
+			}
+		})
+	}
+}
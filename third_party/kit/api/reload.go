@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConfigReloader reloads the configuration of a service at runtime, publishing
+// each valid configuration to its subscribers.
+//
+// Fields that can't change without a restart, i.e. the address a server
+// listens on, are tagged with `reload:"restart"`. Tagging a struct field marks
+// every field within it. Changes to these fields are logged as requiring a
+// restart, and are not applied, so the published configuration always
+// reflects what is running.
+type ConfigReloader struct {
+	logger    *zap.SugaredLogger
+	args      []string
+	namespace string
+	path      string
+	validate  func(cfg interface{}) error
+
+	// current holds the current configuration
+	current atomic.Value
+
+	// mu serialises reloads, and guards subs.
+	mu   sync.Mutex
+	subs []func(cfg interface{})
+}
+
+// NewConfigReloader returns a ConfigReloader of the configuration cfg, a
+// pointer to a configuration struct that has already been parsed with
+// ParseConfig using the given args, namespace and path. Reloads parse into a
+// new struct of the same type, and are rejected if validate, if not nil,
+// returns an error.
+func NewConfigReloader(logger *zap.SugaredLogger, args []string, namespace, path string, cfg interface{}, validate func(cfg interface{}) error) *ConfigReloader {
+	r := ConfigReloader{
+		logger:    logger,
+		args:      args,
+		namespace: namespace,
+		path:      path,
+		validate:  validate,
+	}
+	r.current.Store(cfg)
+	return &r
+}
+
+// Current returns the current configuration, a pointer to a struct of the type
+// given to NewConfigReloader. It must not be modified.
+func (r *ConfigReloader) Current() interface{} {
+	return r.current.Load()
+}
+
+// Subscribe adds a function that is called with every configuration that is
+// published by a reload. The configuration must not be modified.
+func (r *ConfigReloader) Subscribe(fn func(cfg interface{})) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subs = append(r.subs, fn)
+}
+
+// Reload parses the configuration again, validates it, and publishes it. If it
+// can't be parsed or is invalid, the error is logged and returned, and the
+// current configuration is kept.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.current.Load()
+
+	// Parse into a fresh struct, so the current one is never partially updated
+	cfg := reflect.New(reflect.TypeOf(old).Elem()).Interface()
+	if _, err := ParseConfig(r.args, r.namespace, r.path, cfg); err != nil {
+		r.logger.Errorw("config reload rejected", "error", err)
+		return err
+	}
+
+	if r.validate != nil {
+		if err := r.validate(cfg); err != nil {
+			r.logger.Errorw("config reload rejected", "error", err)
+			return err
+		}
+	}
+
+	// Keep the current value of fields that need a restart to change
+	var changed, restart []string
+	diffConfig(reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem(), "", false, &changed, &restart)
+	if len(restart) > 0 {
+		r.logger.Warnw("config changes require a restart", "fields", restart)
+	}
+	if len(changed) == 0 {
+		r.logger.Infow("config reloaded, nothing changed")
+		return nil
+	}
+
+	r.current.Store(cfg)
+	r.logger.Infow("config reloaded", "fields", changed)
+
+	for _, fn := range r.subs {
+		fn(cfg)
+	}
+
+	return nil
+}
+
+// diffConfig compares the fields of two configuration structs, adding the
+// paths of fields that changed to changed. Fields that need a restart are
+// instead added to restart, and reset to their old value in cfg.
+func diffConfig(old, cfg reflect.Value, path string, needsRestart bool, changed, restart *[]string) {
+	if needsRestart {
+		if !reflect.DeepEqual(old.Interface(), cfg.Interface()) {
+			*restart = append(*restart, path)
+			cfg.Set(old)
+		}
+		return
+	}
+
+	if cfg.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(old.Interface(), cfg.Interface()) {
+			*changed = append(*changed, path)
+		}
+		return
+	}
+
+	for i := 0; i < cfg.NumField(); i++ {
+		f := cfg.Type().Field(i)
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := f.Name
+		if path != "" {
+			name = path + "." + name
+		}
+		diffConfig(old.Field(i), cfg.Field(i), name, f.Tag.Get("reload") == "restart", changed, restart)
+	}
+}
+
+// Watch reloads the configuration whenever the process receives a SIGHUP, or
+// the configuration file changes, until ctx is done. The file is checked for
+// changes every interval.
+func (r *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := r.fileVersion()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Infow("config reload requested", "trigger", "SIGHUP")
+			last = r.fileVersion()
+		case <-ticker.C:
+			v := r.fileVersion()
+			if v == last {
+				continue
+			}
+			last = v
+			r.logger.Infow("config reload requested", "trigger", "file", "path", r.path)
+		}
+
+		// Errors are logged by Reload
+		r.Reload()
+	}
+}
+
+// fileVersion identifies the version of the configuration file, so changes can
+// be detected. It is empty if there is no file.
+func (r *ConfigReloader) fileVersion() string {
+	if r.path == "" {
+		return ""
+	}
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return ""
+	}
+	return fi.ModTime().String() + "/" + strconv.FormatInt(fi.Size(), 10)
+}
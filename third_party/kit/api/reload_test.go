@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// reloadConfig is a configuration that is reloaded
+type reloadConfig struct {
+	Level string
+	Web   struct {
+		Addr    string `reload:"restart"`
+		Timeout time.Duration
+	}
+	Workers int `reload:"restart"`
+}
+
+// writeConfig writes the configuration file at path, with the given
+// modification time.
+func writeConfig(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+	writeFile(t, filepath.Dir(path), filepath.Base(path), data)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestReloader returns a reloader of the configuration in the file at
+// path, publishing configurations to the returned channel.
+func newTestReloader(t *testing.T, tl *testLog, path string, validate func(interface{}) error) (*ConfigReloader, chan *reloadConfig) {
+	t.Helper()
+	var cfg reloadConfig
+	if _, err := ParseConfig(nil, "TEST", path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewConfigReloader(tl.logger(), nil, "TEST", path, &cfg, validate)
+	published := make(chan *reloadConfig, 10)
+	r.Subscribe(func(cfg interface{}) {
+		published <- cfg.(*reloadConfig)
+	})
+	return r, published
+}
+
+func TestConfigReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	start := time.Now().Add(-time.Hour)
+	writeConfig(t, path, `{"level": "info", "web": {"addr": ":8080", "timeout": "1s"}, "workers": 2}`, start)
+
+	var tl testLog
+	r, published := newTestReloader(t, &tl, path, func(cfg interface{}) error {
+		if cfg.(*reloadConfig).Level == "" {
+			return errors.New("level is required")
+		}
+		return nil
+	})
+	initial := r.Current().(*reloadConfig)
+
+	// Changes are published, except to fields needing a restart
+	writeConfig(t, path, `{"level": "debug", "web": {"addr": ":9090", "timeout": "2s"}, "workers": 4}`, start)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := <-published
+	if cfg.Level != "debug" || cfg.Web.Timeout != 2*time.Second || cfg.Web.Addr != ":8080" || cfg.Workers != 2 {
+		t.Errorf("published %+v, want the new level and timeout only", cfg)
+	}
+	if r.Current() != cfg || initial.Level != "info" {
+		t.Error("current config wasn't replaced")
+	}
+	var warned bool
+	for _, e := range tl.entries() {
+		warned = warned || (e.Level == "warn" && e.Msg == "config changes require a restart")
+	}
+	if !warned {
+		t.Error("changes requiring a restart weren't logged")
+	}
+
+	// Reloads that change nothing publish nothing
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configurations are rejected
+	for _, data := range []string{`{"level": `, `{"level": ""}`} {
+		writeConfig(t, path, data, start)
+		if err := r.Reload(); err == nil {
+			t.Errorf("config %s was accepted, want it rejected", data)
+		}
+	}
+	if r.Current() != cfg {
+		t.Error("rejected config replaced the current config")
+	}
+
+	select {
+	case cfg := <-published:
+		t.Errorf("published %+v, want nothing", cfg)
+	default:
+	}
+}
+
+func TestConfigReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	start := time.Now().Add(-time.Hour)
+	writeConfig(t, path, `{"level": "info"}`, start)
+
+	var tl testLog
+	r, published := newTestReloader(t, &tl, path, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.Watch(ctx, 5*time.Millisecond)
+		close(stopped)
+	}()
+
+	// Reload when the file changes. Watch may not have started yet, so keep
+	// touching the file until the change is seen.
+	writeConfig(t, path, `{"level": "warn"}`, start)
+	var cfg *reloadConfig
+	for i := 1; cfg == nil; i++ {
+		if i > 100 {
+			t.Fatal("file change wasn't reloaded")
+		}
+		mtime := start.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cfg = <-published:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if cfg.Level != "warn" {
+		t.Errorf("published level %q, want warn", cfg.Level)
+	}
+
+	// Let Watch see the last change, so only SIGHUP triggers the next reload
+	time.Sleep(20 * time.Millisecond)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload on SIGHUP, even if the file looks unchanged
+	writeConfig(t, path, `{"level": "info"}`, fi.ModTime())
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-published:
+		if cfg.Level != "info" {
+			t.Errorf("published level %q, want info", cfg.Level)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SIGHUP wasn't reloaded")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Watch didn't return once cancelled")
+	}
+}
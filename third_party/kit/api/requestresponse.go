@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Respond should be used to respond to a http request within a http handler.
+// Respond encodes any data passed in as JSON.
+// Respond also sets the status code of the response on the request details, so
+// middlewares can access this value.
+// Successful GET responses of endpoints with SparseFields select the fields
+// asked for, see Endpoint.SparseFields.
+func Respond(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	status, jsonData := encodeResponse(r, status, data)
+	writeResponse(w, r, status, jsonData)
+}
+
+// encodeResponse encodes the data of a response as JSON, selecting the fields
+// asked for if the endpoint allows it. It returns the status to respond with,
+// which is changed if the data can't be responded with.
+func encodeResponse(r *http.Request, status int, data interface{}) (int, []byte) {
+	// If we have no data to respond with, there's nothing to encode.
+	if data == nil {
+		return status, nil
+	}
+
+	// Select the fields asked for, on successful responses only
+	if status >= 200 && status < 300 && sparseFields(r) {
+		var ok bool
+		if data, ok = selectFields(r, data); !ok {
+			status = http.StatusBadRequest
+		}
+	}
+
+	// Marshal data into byte array
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		// There was an error Marshalling, so return a server error
+		return http.StatusInternalServerError, []byte(`{"msg": "Internal Server Error"}`)
+	}
+	return status, jsonData
+}
+
+// writeResponse writes a response with the given status and JSON body.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, jsonData []byte) {
+	// If we have data to respond with, set the correct header.
+	if jsonData != nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// Set status code value on request details so other middlewares can access it
+	if d := getDetails(r); d != nil {
+		d.StatusCode = status
+	}
+
+	// Set the status code of the response. This should be the last header to be written.
+	w.WriteHeader(status)
+
+	// Write the JSON body. This must be done last, otherwise we flush the response too quickly.
+	if len(jsonData) > 0 {
+		w.Write(jsonData)
+	}
+}
+
+// ErrorBody is the standard body of error responses.
+type ErrorBody struct {
+	Msg string `json:"msg"`
+}
+
+// RespondError should be used to respond to a http request with an error
+// status. The body is an ErrorBody holding the text of the status code.
+func RespondError(w http.ResponseWriter, r *http.Request, status int) {
+	Respond(w, r, status, ErrorBody{Msg: http.StatusText(status)})
+}
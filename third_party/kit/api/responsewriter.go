@@ -0,0 +1,59 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// recorder wraps a http.ResponseWriter, recording the status code and number
+// of bytes written to it.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, if the wrapped http.ResponseWriter does.
+func (rec *recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingBody wraps a request body, counting the bytes read from it. The
+// count is updated atomically, as a timed out handler may still be reading.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read implements io.Reader
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes read so far.
+func (b *countingBody) count() int64 {
+	return atomic.LoadInt64(&b.n)
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret is a configuration value that is kept out of logs and the
+// environment. It implements conf.Setter, and may be set to a reference to
+// where the secret is stored, rather than the secret itself:
+//
+//	file:///var/run/secrets/db-password   the contents of the file
+//	env-file:/var/run/secrets/db.env#KEY  the value of KEY in a file of KEY=VALUE lines
+//
+// Other values are used as they are. Trailing newlines are trimmed. A Secret
+// always prints as [REDACTED], so it is hidden by conf.String and LogConfig,
+// and is reported as noprint by ParseConfig, without needing to be tagged.
+// Referenced secrets that are rotated are picked up by reloading the
+// configuration, see ConfigReloader.WatchSecrets.
+//
+// The Secret holds the value or reference as configured, and the secret it was
+// resolved to when it was set. Use Value to get the secret.
+type Secret string
+
+// secretSep separates the reference of a Secret from the secret it was resolved
+// to.
+const secretSep = "\x00"
+
+// Set implements conf.Setter, resolving the given value or reference.
+func (s *Secret) Set(ref string) error {
+	value, err := resolveSecret(ref)
+	if err != nil {
+		return err
+	}
+	*s = Secret(ref + secretSep + value)
+	return nil
+}
+
+// Ref returns the value or reference the Secret was set to.
+func (s Secret) Ref() string {
+	ref, _, _ := s.split()
+	return ref
+}
+
+// Value returns the secret. If the secret hasn't been resolved, i.e. because
+// the Secret wasn't set by conf, it is resolved now, and is empty if that fails.
+func (s Secret) Value() string {
+	ref, value, ok := s.split()
+	if ok {
+		return value
+	}
+	value, _ = resolveSecret(ref)
+	return value
+}
+
+// split returns the reference of the Secret, and the secret it was resolved to,
+// if it has been.
+func (s Secret) split() (string, string, bool) {
+	i := strings.Index(string(s), secretSep)
+	if i < 0 {
+		return string(s), "", false
+	}
+	return string(s[:i]), string(s[i+len(secretSep):]), true
+}
+
+// String implements fmt.Stringer, hiding the secret.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString implements fmt.GoStringer, hiding the secret from %#v.
+func (s Secret) GoString() string {
+	return fmt.Sprintf("api.Secret(%q)", s.String())
+}
+
+// MarshalText implements encoding.TextMarshaler, hiding the secret from
+// encoders, i.e. when logged with zap.Any.
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Rotated re-reads a referenced secret, returning whether it has changed since
+// the Secret was resolved.
+func (s Secret) Rotated() (bool, error) {
+	ref, value, ok := s.split()
+	if !ok || ref == "" {
+		return false, nil
+	}
+
+	current, err := resolveSecret(ref)
+	if err != nil {
+		return false, err
+	}
+	return current != value, nil
+}
+
+// resolveSecret returns the secret the given reference refers to.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "file://"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+
+	case strings.HasPrefix(ref, "env-file:"):
+		ref = strings.TrimPrefix(ref, "env-file:")
+		i := strings.LastIndex(ref, "#")
+		if i < 0 {
+			return "", fmt.Errorf("env-file reference must name a key, i.e. env-file:/path#KEY")
+		}
+		path, key := ref[:i], ref[i+1:]
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		value, ok, err := envFileValue(b, key)
+		if err != nil {
+			return "", fmt.Errorf("env-file %s: %w", path, err)
+		}
+		if !ok {
+			return "", fmt.Errorf("env-file %s: key %s not found", path, key)
+		}
+		return value, nil
+	}
+
+	return strings.TrimRight(ref, "\r\n"), nil
+}
+
+// envFileValue returns the value of key in a file of KEY=VALUE lines, as used
+// by docker --env-file. Blank lines, comments and "export" prefixes are
+// ignored, and values may be quoted.
+func envFileValue(data []byte, key string) (string, bool, error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for num := 1; s.Scan(); num++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return "", false, fmt.Errorf("line %d: expected KEY=VALUE", num)
+		}
+		if strings.TrimSpace(line[:i]) != key {
+			continue
+		}
+
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return "", false, fmt.Errorf("line %d: %w", num, err)
+			}
+			value = v
+		case strings.HasPrefix(value, "'") && len(value) > 1 && strings.HasSuffix(value, "'"):
+			value = value[1 : len(value)-1]
+		}
+		return value, true, nil
+	}
+	return "", false, s.Err()
+}
+
+// secretType is the type of Secret, used to find secrets within a configuration
+var secretType = reflect.TypeOf(Secret(""))
+
+// WatchSecrets re-reads every referenced Secret within the current
+// configuration every interval until ctx is done, and reloads the
+// configuration when any of them is rotated, so the new secrets are
+// published to subscribers. Rotations and failures to re-read a secret are
+// logged, without the secret.
+func (r *ConfigReloader) WatchSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		secrets := make(map[string]Secret)
+		findSecrets(reflect.ValueOf(r.Current()), "", secrets)
+
+		var rotated []string
+		for name, s := range secrets {
+			changed, err := s.Rotated()
+			if err != nil {
+				r.logger.Errorw("secret reload failed", "secret", name, "error", err)
+				continue
+			}
+			if changed {
+				rotated = append(rotated, name)
+			}
+		}
+		if len(rotated) == 0 {
+			continue
+		}
+
+		sort.Strings(rotated)
+		r.logger.Infow("config reload requested", "trigger", "secret", "secrets", rotated)
+
+		// Errors are logged by Reload
+		r.Reload()
+	}
+}
+
+// findSecrets adds the Secrets within v to secrets, named by their field path.
+func findSecrets(v reflect.Value, path string, secrets map[string]Secret) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == secretType {
+		secrets[path] = v.Interface().(Secret)
+		return
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := f.Name
+		if path != "" {
+			name = path + "." + name
+		}
+		findSecrets(v.Field(i), name, secrets)
+	}
+}
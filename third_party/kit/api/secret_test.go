@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeFile(t, dir, "password", "hunter2\n")
+	env := writeFile(t, dir, "db.env", "# db\nexport USER=app\nPASSWORD=\"hunter 3\"\nTOKEN='t0k'\n")
+
+	tests := []struct {
+		ref   string
+		value string
+		err   bool
+	}{
+		{ref: "plain\n", value: "plain"},
+		{ref: "file://" + file, value: "hunter2"},
+		{ref: "env-file:" + env + "#USER", value: "app"},
+		{ref: "env-file:" + env + "#PASSWORD", value: "hunter 3"},
+		{ref: "env-file:" + env + "#TOKEN", value: "t0k"},
+		{ref: "env-file:" + env + "#MISSING", err: true},
+		{ref: "env-file:" + env, err: true},
+		{ref: "file://" + filepath.Join(dir, "missing"), err: true},
+	}
+	for _, tt := range tests {
+		var s Secret
+		err := s.Set(tt.ref)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Set(%q) succeeded, want an error", tt.ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q): %v", tt.ref, err)
+			continue
+		}
+		if s.Value() != tt.value {
+			t.Errorf("Set(%q).Value() = %q, want %q", tt.ref, s.Value(), tt.value)
+		}
+		if s.Ref() != tt.ref {
+			t.Errorf("Set(%q).Ref() = %q", tt.ref, s.Ref())
+		}
+
+		// The secret is never printed
+		for _, format := range []string{"%v", "%s", "%#v", "%+v"} {
+			if out := fmt.Sprintf(format, struct{ S Secret }{s}); strings.Contains(out, tt.value) {
+				t.Errorf("%s printed the secret: %s", format, out)
+			}
+		}
+	}
+
+	// Secrets that weren't set by conf are resolved when read
+	if v := Secret("file://" + file).Value(); v != "hunter2" {
+		t.Errorf("Value() = %q, want %q", v, "hunter2")
+	}
+}
+
+func TestSecretRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "password", "hunter2")
+
+	var s Secret
+	if err := s.Set("file://" + file); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err := s.Rotated(); rotated || err != nil {
+		t.Errorf("Rotated() = %t, %v, want false", rotated, err)
+	}
+
+	writeFile(t, dir, "password", "hunter3")
+	if rotated, err := s.Rotated(); !rotated || err != nil {
+		t.Errorf("Rotated() = %t, %v, want true", rotated, err)
+	}
+	// The Secret keeps the value it was resolved to
+	if s.Value() != "hunter2" {
+		t.Errorf("Value() = %q, want %q", s.Value(), "hunter2")
+	}
+
+	os.Remove(file)
+	if _, err := s.Rotated(); err == nil {
+		t.Error("Rotated() succeeded for a missing file")
+	}
+}
+
+// secretConfig is a configuration with secrets
+type secretConfig struct {
+	Password Secret
+	Key      Secret `reload:"restart"`
+}
+
+func TestSecretReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	password := writeFile(t, dir, "password", "hunter2")
+	key := writeFile(t, dir, "key", "k1")
+
+	args := []string{"--password=file://" + password, "--key=file://" + key}
+	var cfg secretConfig
+	if _, err := ParseConfig(args, "TEST", "", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password.Value() != "hunter2" || cfg.Key.Value() != "k1" {
+		t.Fatalf("secrets = %q %q", cfg.Password.Value(), cfg.Key.Value())
+	}
+
+	reject := true
+	r := NewConfigReloader(zap.NewNop().Sugar(), args, "TEST", "", &cfg, func(interface{}) error {
+		if reject {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	current := func() *secretConfig {
+		return r.Current().(*secretConfig)
+	}
+
+	// Rejected reloads don't change the current secrets
+	writeFile(t, dir, "password", "hunter3")
+	writeFile(t, dir, "key", "k2")
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload succeeded, want it rejected")
+	}
+	if v := current().Password.Value(); v != "hunter2" {
+		t.Errorf("Password = %q after a rejected reload, want %q", v, "hunter2")
+	}
+	if cfg.Password.Value() != "hunter2" {
+		t.Errorf("Password = %q after a rejected reload, want %q", cfg.Password.Value(), "hunter2")
+	}
+
+	// Accepted reloads publish new secrets, except those needing a restart
+	reject = false
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v := current().Password.Value(); v != "hunter3" {
+		t.Errorf("Password = %q, want %q", v, "hunter3")
+	}
+	if v := current().Key.Value(); v != "k1" {
+		t.Errorf("Key = %q, want %q as it needs a restart", v, "k1")
+	}
+	if cfg.Password.Value() != "hunter2" {
+		t.Errorf("the old configuration changed to %q", cfg.Password.Value())
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/ksuid"
+	"go.uber.org/zap"
+)
+
+type server struct {
+	router *httprouter.Router
+	// batchRouter routes the sub-requests of batches, see NewBatchAPI, to the
+	// same endpoints, without the server wide middleware.
+	batchRouter  *httprouter.Router
+	logger       *zap.SugaredLogger
+	traceProject string
+	mw           []Middleware
+	// conns tracks the server's connections, if set.
+	conns *connTracker
+}
+
+// ServerOptions configures a server returned by NewServerWithOptions.
+type ServerOptions struct {
+	// Whether to log requests as Cloud Logging access logs using AccessLogMW,
+	// rather than with LogMW.
+	AccessLog bool
+	// The version of the API, i.e. "v1", used to label access logs.
+	APIVersion string
+	// The Google Cloud project traces are recorded in, used to correlate logs
+	// with traces, see Logger. If empty, logs aren't correlated.
+	TraceProject string
+}
+
+// logMW returns the middleware logging requests, as chosen by the options.
+func (o ServerOptions) logMW(logger *zap.SugaredLogger) Middleware {
+	if o.AccessLog {
+		return AccessLogMW(logger, o.APIVersion)
+	}
+	return LogMW(logger)
+}
+
+// NewServer returns a HTTP server for accessing the the given API.
+func NewServer(addr string, logger *zap.SugaredLogger, a API) http.Server {
+	return NewServerWithOptions(addr, logger, a, ServerOptions{})
+}
+
+// NewServerWithOptions returns a HTTP server for accessing the given API, as
+// NewServer does, configured by the given options.
+func NewServerWithOptions(addr string, logger *zap.SugaredLogger, a API, opts ServerOptions) http.Server {
+	return *newHTTPServer(addr, logger, a, opts, 0)
+}
+
+// newHTTPServer returns a HTTP server for accessing the given API, configured
+// by the given options, limited to maxConns connections when served by serve.
+func newHTTPServer(addr string, logger *zap.SugaredLogger, a API, opts ServerOptions, maxConns int) *http.Server {
+	// Create our server, with default middlewares
+	s := newServer(logger, a, []Middleware{opts.logMW(logger), MetricsMW()})
+	s.traceProject = opts.TraceProject
+	s.conns = newConnTracker(prometheus.DefaultRegisterer, nil, maxConns)
+
+	// Convert our server into a http.Server
+	return &http.Server{
+		Addr:        addr,
+		Handler:     s,
+		ConnContext: withConn,
+		ConnState:   s.conns.connState,
+	}
+}
+
+// newServer returns a server that routes requests to the endpoints of the given
+// API, wrapping each in the given server wide middleware.
+func newServer(logger *zap.SugaredLogger, a API, mw []Middleware) *server {
+	s := server{
+		router:      httprouter.New(),
+		batchRouter: httprouter.New(),
+		logger:      logger,
+		mw:          mw,
+	}
+
+	// Add all endpoints to the server's router
+	for _, e := range a.Endpoints() {
+		s.handle(e)
+	}
+
+	return &s
+}
+
+// handle registers the endpoint's handler, with its middleware and limits, to
+// the server's router
+func (s *server) handle(e Endpoint) {
+	method, path := e.Method, e.Path
+
+	// First wrap the handler with its specific middleware
+	handler := wrapMiddleware(e.Middlewares, e.Handler)
+
+	// Then enforce any limits the endpoint declares, recording how the request
+	// finished once they have all run
+	limits := []Middleware{statusMW()}
+	if e.WriteTimeout > 0 {
+		limits = append(limits, writeTimeoutMW(e.WriteTimeout))
+	}
+	if e.MaxBodyBytes > 0 {
+		limits = append(limits, bodyLimitMW(e.MaxBodyBytes))
+	}
+	if e.Timeout > 0 {
+		limits = append(limits, timeoutMW(e.Timeout))
+	}
+	if e.RequireIfMatch {
+		limits = append(limits, requireIfMatchMW())
+	}
+	handler = wrapMiddleware(limits, handler)
+
+	// Sub-requests of batches are routed to the handler without the server's
+	// middleware, which has already run for the batch
+	s.batchRouter.HandlerFunc(method, path, s.withDetails(e, handler))
+
+	// Then wrap the handler in the server's middleware
+	handler = wrapMiddleware(s.mw, handler)
+
+	// Register the handler to the router
+	s.router.HandlerFunc(method, path, s.withDetails(e, handler))
+}
+
+// withDetails returns a handler calling the given handler of the endpoint,
+// with the details of each request, and the server, in its context.
+func (s *server) withDetails(e Endpoint, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// Set the context with the required details to process the request
+		d := Details{
+			Now:          time.Now(),
+			RequestID:    ksuid.New().String(), // TODO: Get from request to add some request tracing.
+			Method:       e.Method,
+			RequestPath:  e.Path,
+			Critical:     e.Critical,
+			SparseFields: e.SparseFields,
+		}
+		d.TraceID, d.SpanID, d.TraceSampled = traceFromRequest(r)
+
+		// Sub-requests of a batch skip the server's middleware, which ran for
+		// the batch, so are made by its principal, in its trace
+		if batch, ok := ctx.Value(keyBatch).(*Details); ok {
+			d.Principal = batch.Principal
+			d.TraceID, d.SpanID, d.TraceSampled = batch.TraceID, batch.SpanID, batch.TraceSampled
+		}
+
+		// Add details to the context, so other functions can access them.
+		ctx = context.WithValue(ctx, KeyDetails, &d)
+
+		// Add our logger to the context, so handlers can log with it.
+		ctx = context.WithValue(ctx, keyLogger, serverLogger{logger: s.logger, traceProject: s.traceProject})
+
+		// Add the server to the context, so batches can dispatch to it.
+		ctx = context.WithValue(ctx, keyServer, s)
+
+		// Call the wrapped handler
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tlsCheckInterval is how often the files of a TLS config are checked for changes
+const tlsCheckInterval = time.Second
+
+// NewTLSConfig returns a TLS config serving the certificate and key in the
+// given PEM files. If clientCAFile is set, clients must present a certificate
+// signed by a CA in that PEM bundle, and their identity can be used as the
+// principal of their requests using ClientCertAuthMW.
+//
+// The files are reloaded in the background when they change, so certificates
+// can be rotated without a restart. If the new files can't be loaded, i.e.
+// because only one of the certificate and key has been replaced so far, the
+// failure is logged and the previous config keeps being used.
+func NewTLSConfig(logger *zap.SugaredLogger, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	f := tlsFiles{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   clientCAFile,
+		logger:   logger,
+		interval: tlsCheckInterval,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The config actually used is decided per connection, so it reflects
+		// the latest files. A certificate is also given here, so that
+		// http.Server knows one is configured.
+		GetConfigForClient: f.configForClient,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cfg, _ := f.configForClient(nil)
+			return &cfg.Certificates[0], nil
+		},
+	}, nil
+}
+
+// tlsFiles is a TLS config loaded from files, reloaded when they change
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+	logger                    *zap.SugaredLogger
+	// How often the files are checked for changes.
+	interval time.Duration
+
+	mu      sync.Mutex
+	config  *tls.Config
+	version string
+	// The version of the files that last failed to load, so that the failure
+	// is only logged once.
+	failed    string
+	checked   time.Time
+	reloading bool
+}
+
+// configForClient returns the current config. If it hasn't been checked
+// recently, its files are reloaded in the background if they have changed, so
+// that handshakes aren't held up.
+func (f *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.reloading && time.Since(f.checked) >= f.interval {
+		f.checked = time.Now()
+		f.reloading = true
+		go f.reloadChanged()
+	}
+
+	return f.config, nil
+}
+
+// reloadChanged reloads the config if its files have changed. If they can't be
+// loaded, the failure is logged, and the current config kept.
+func (f *tlsFiles) reloadChanged() {
+	f.mu.Lock()
+	current, failed := f.version, f.failed
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.reloading = false
+		f.mu.Unlock()
+	}()
+
+	version := f.filesVersion()
+	if version == current || version == failed {
+		return
+	}
+
+	if err := f.reload(); err != nil {
+		f.mu.Lock()
+		f.failed = version
+		f.mu.Unlock()
+		f.logger.Errorw("TLS files changed, but can't be loaded, keeping the current certificate", "error", err)
+		return
+	}
+
+	f.logger.Infow("TLS files reloaded", "cert_file", f.certFile)
+}
+
+// reload loads the config from its files, replacing the current config.
+func (f *tlsFiles) reload() error {
+	version := f.filesVersion()
+
+	cfg, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.config = cfg
+	f.version = version
+	f.checked = time.Now()
+	return nil
+}
+
+// load loads a config from the files.
+func (f *tlsFiles) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	cfg := tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("loading TLS client CA: no certificates found")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &cfg, nil
+}
+
+// filesVersion identifies the version of the config's files, so changes can be
+// detected.
+func (f *tlsFiles) filesVersion() string {
+	var v string
+	for _, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			v += fi.ModTime().String() + "/" + strconv.FormatInt(fi.Size(), 10) + ";"
+		}
+	}
+	return v
+}
+
+// ClientIdentity returns the identity of a client certificate. This is its
+// first URI SAN, i.e. a SPIFFE id, or its first DNS SAN, or its first email
+// SAN, or its common name.
+func ClientIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate with the given common name, and
+// its key, to cert.pem and key.pem in dir, with the given modification time.
+func writeCert(t *testing.T, dir, name string, mtime time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	for _, file := range []string{"cert.pem", "key.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, file), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// servedName returns the common name of the certificate served by f, waiting
+// for it to become want.
+func servedName(t *testing.T, f *tlsFiles, want string) string {
+	t.Helper()
+	var name string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		cfg, err := f.configForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name = cert.Subject.CommonName; name == want {
+			break
+		}
+	}
+	return name
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tl testLog
+	cert, key, ca := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	if _, err := NewTLSConfig(tl.logger(), cert, key, ""); err == nil {
+		t.Error("missing files succeeded, want error")
+	}
+
+	writeCert(t, dir, "first", time.Now())
+	cfg, err := NewTLSConfig(tl.logger(), cert, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || len(got.Certificates) != 1 || got.ClientAuth != tls.NoClientCert {
+		t.Errorf("config = %+v, %v", got, err)
+	}
+
+	// Client certificates are required if a CA is given
+	writeFile(t, dir, "ca.pem", "not a certificate")
+	if _, err := NewTLSConfig(tl.logger(), cert, key, ca); err == nil {
+		t.Error("invalid CA succeeded, want error")
+	}
+	writeFile(t, dir, "ca.pem", string(mustReadFile(t, cert)))
+	if cfg, err = NewTLSConfig(tl.logger(), cert, key, ca); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cfg.GetConfigForClient(&tls.ClientHelloInfo{}); got.ClientAuth != tls.RequireAndVerifyClientCert || got.ClientCAs == nil {
+		t.Errorf("config = %+v, want client certificates required", got)
+	}
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tl testLog
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, dir, "first", start)
+	f := tlsFiles{
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+		logger:   tl.logger(),
+	}
+	if err := f.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated files are loaded
+	writeCert(t, dir, "second", start.Add(time.Minute))
+	if got := servedName(t, &f, "second"); got != "second" {
+		t.Fatalf("serving %q, want second", got)
+	}
+
+	// Files that can't be loaded are reported once, and the current config kept
+	f.waitReloaded()
+	writeFile(t, dir, "key.pem", "not a key")
+	if err := os.Chtimes(f.keyFile, start.Add(2*time.Minute), start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); len(f.failedVersion()) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		f.configForClient(nil)
+	}
+	for i := 0; i < 10; i++ {
+		f.configForClient(nil)
+		time.Sleep(time.Millisecond)
+	}
+	if got := servedName(t, &f, "second"); got != "second" {
+		t.Errorf("serving %q, want second", got)
+	}
+
+	entries := tl.entries()
+	var failures int
+	for _, e := range entries {
+		if e.Level == "error" {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Errorf("entries = %+v, want one error", entries)
+	}
+}
+
+// waitReloaded waits for any reload in the background to finish, so that it
+// doesn't see files part way through being written.
+func (f *tlsFiles) waitReloaded() {
+	for {
+		f.mu.Lock()
+		reloading := f.reloading
+		f.mu.Unlock()
+		if !reloading {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// failedVersion returns the version of the files that last failed to load.
+func (f *tlsFiles) failedVersion() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failed
+}
+
+// mustReadFile returns the contents of the named file.
+func mustReadFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestClientIdentity(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.org/svc")
+	tests := []struct {
+		cert x509.Certificate
+		want string
+	}{
+		{x509.Certificate{URIs: []*url.URL{u}, DNSNames: []string{"svc.example.org"}}, "spiffe://example.org/svc"},
+		{x509.Certificate{DNSNames: []string{"svc.example.org"}, EmailAddresses: []string{"svc@example.org"}}, "svc.example.org"},
+		{x509.Certificate{EmailAddresses: []string{"svc@example.org"}, Subject: pkix.Name{CommonName: "svc"}}, "svc@example.org"},
+		{x509.Certificate{Subject: pkix.Name{CommonName: "svc"}}, "svc"},
+	}
+	for _, tt := range tests {
+		if got := ClientIdentity(&tt.cert); got != tt.want {
+			t.Errorf("ClientIdentity() = %q, want %q", got, tt.want)
+		}
+	}
+}
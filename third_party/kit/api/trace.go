@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// traceFromRequest returns the trace context propagated by the client of a
+// request, if any. Both W3C traceparent and Google Cloud X-Cloud-Trace-Context
+// headers are understood, with traceparent preferred.
+func traceFromRequest(r *http.Request) (traceID, spanID string, sampled bool) {
+	// traceparent is formatted as "version-traceid-spanid-flags", i.e.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	if h := r.Header.Get("traceparent"); h != "" {
+		parts := strings.Split(h, "-")
+		if len(parts) >= 4 && len(parts[0]) == 2 && isHex(parts[0]) && parts[0] != "ff" && validID(parts[1], 32) && validID(parts[2], 16) && len(parts[3]) == 2 {
+			flags, err := strconv.ParseUint(parts[3], 16, 8)
+			if err == nil {
+				return parts[1], parts[2], flags&1 == 1
+			}
+		}
+	}
+
+	// X-Cloud-Trace-Context is formatted as "traceid/spanid;o=options", where
+	// the span id is decimal and both it and the options are optional, i.e.
+	// 105445aa7843bc8bf206b120001000/1;o=1
+	if h := r.Header.Get("X-Cloud-Trace-Context"); h != "" {
+		h, opts := cut(h, ";")
+		traceID, span := cut(h, "/")
+		traceID = strings.ToLower(traceID)
+		if !validID(traceID, 32) {
+			return "", "", false
+		}
+		if id, err := strconv.ParseUint(span, 10, 64); err == nil && id != 0 {
+			spanID = fmt.Sprintf("%016x", id)
+		}
+		return traceID, spanID, opts == "o=1"
+	}
+
+	return "", "", false
+}
+
+// validID returns whether id is n lowercase hex digits, that aren't all zero,
+// as trace and span ids must be.
+func validID(id string, n int) bool {
+	return len(id) == n && isHex(id) && strings.Trim(id, "0") != ""
+}
+
+// isHex returns whether s is lowercase hex digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// cut slices s around the first instance of sep, returning the text before
+// and after it. If sep is not found, s and "" are returned.
+func cut(s, sep string) (before, after string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
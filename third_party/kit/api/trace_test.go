@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceFromRequest(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		traceID string
+		spanID  string
+		sampled bool
+	}{
+		{name: "traceparent", header: "traceparent", value: "00-" + traceID + "-" + spanID + "-01", traceID: traceID, spanID: spanID, sampled: true},
+		{name: "traceparent not sampled", header: "traceparent", value: "00-" + traceID + "-" + spanID + "-00", traceID: traceID, spanID: spanID},
+		{name: "traceparent future version", header: "traceparent", value: "01-" + traceID + "-" + spanID + "-01-extra", traceID: traceID, spanID: spanID, sampled: true},
+		{name: "traceparent invalid version", header: "traceparent", value: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "traceparent zero trace", header: "traceparent", value: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "traceparent zero span", header: "traceparent", value: "00-" + traceID + "-0000000000000000-01"},
+		{name: "traceparent not hex", header: "traceparent", value: "00-4bf92f3577b34da6a3ce929d0e0e473z-" + spanID + "-01"},
+		{name: "traceparent upper case", header: "traceparent", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01"},
+		{name: "traceparent short", header: "traceparent", value: "00-" + traceID[1:] + "-" + spanID + "-01"},
+		{name: "cloud", header: "X-Cloud-Trace-Context", value: traceID + "/1;o=1", traceID: traceID, spanID: "0000000000000001", sampled: true},
+		{name: "cloud upper case", header: "X-Cloud-Trace-Context", value: "4BF92F3577B34DA6A3CE929D0E0E4736", traceID: traceID},
+		{name: "cloud zero span", header: "X-Cloud-Trace-Context", value: traceID + "/0;o=1", traceID: traceID, sampled: true},
+		{name: "cloud zero trace", header: "X-Cloud-Trace-Context", value: "00000000000000000000000000000000/1;o=1"},
+		{name: "cloud not hex", header: "X-Cloud-Trace-Context", value: "4bf92f3577b34da6a3ce929d0e0e473z/1;o=1"},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		traceID, spanID, sampled := traceFromRequest(r)
+		if traceID != tt.traceID || spanID != tt.spanID || sampled != tt.sampled {
+			t.Errorf("%s: got %q %q %t, want %q %q %t", tt.name, traceID, spanID, sampled, tt.traceID, tt.spanID, tt.sampled)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// jsonExporter writes spans as JSON, one per line
+type jsonExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns a SpanExporter that writes each span as a line of
+// JSON to w, i.e. os.Stdout or a file.
+func NewJSONExporter(w io.Writer) SpanExporter {
+	return &jsonExporter{enc: json.NewEncoder(w)}
+}
+
+// ExportSpans implements SpanExporter
+func (e *jsonExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range spans {
+		if err := e.enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown implements SpanExporter
+func (e *jsonExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP/HTTP
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// NewOTLPExporter returns a SpanExporter that sends spans, as JSON encoded
+// OTLP/HTTP requests, to the given url of an OpenTelemetry collector, i.e.
+// "http://localhost:4318/v1/traces". Spans are attributed to the named service.
+// If client is nil, http.DefaultClient is used.
+func NewOTLPExporter(url, service string, client *http.Client) SpanExporter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &otlpExporter{url: url, service: service, client: client}
+}
+
+// ExportSpans implements SpanExporter
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Drain the body, so the connection can be reused
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export failed: %s", res.Status)
+	}
+	return nil
+}
+
+// Shutdown implements SpanExporter
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest.
+// See https://github.com/open-telemetry/opentelemetry-proto.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 is unset, 2 is error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// request returns the OTLP request exporting the given spans.
+func (e *otlpExporter) request(spans []SpanData) otlpRequest {
+	ss := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/dlmiddlecote/kit/api"},
+	}
+
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute(k, v))
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{otlpAttribute("service.name", e.service)},
+			},
+			ScopeSpans: []otlpScopeSpans{ss},
+		}},
+	}
+}
+
+// otlpAttribute returns the OTLP encoding of an attribute. Values that OTLP
+// can't represent directly are encoded as strings.
+func otlpAttribute(k string, v interface{}) otlpKeyValue {
+	var value map[string]interface{}
+	switch vv := v.(type) {
+	case string:
+		value = map[string]interface{}{"stringValue": vv}
+	case bool:
+		value = map[string]interface{}{"boolValue": vv}
+	case int:
+		// 64 bit integers are encoded as strings in JSON
+		value = map[string]interface{}{"intValue": strconv.Itoa(vv)}
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(vv, 10)}
+	case float64:
+		value = map[string]interface{}{"doubleValue": vv}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprint(vv)}
+	}
+	return otlpKeyValue{Key: k, Value: value}
+}
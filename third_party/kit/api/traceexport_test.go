@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector is a stand-in OpenTelemetry collector, recording the spans it
+// receives.
+type collector struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	status   int
+}
+
+// ServeHTTP implements http.Handler
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var req otlpRequest
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, req)
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+}
+
+// spans returns the spans received, by name.
+func (c *collector) spans() map[string]otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]otlpSpan)
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func TestOTLPExporter(t *testing.T) {
+	c := collector{}
+	ts := httptest.NewServer(&c)
+	defer ts.Close()
+
+	tracer := NewTracer(TracerConfig{Exporter: NewOTLPExporter(ts.URL, "accounts", nil), Registerer: prometheus.NewRegistry()})
+	e := Endpoint{
+		Method: http.MethodGet,
+		Path:   "/accounts/:id",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, s := StartSpan(r.Context(), "db.query")
+			s.SetAttribute("rows", 3)
+			s.End()
+			RespondError(w, r, http.StatusServiceUnavailable)
+		}),
+		Middlewares: []Middleware{TraceMW(tracer)},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/accounts/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handleTest(r, e)
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := c.spans()
+	server, child := spans["/accounts/:id"], spans["db.query"]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != SpanKindServer {
+		t.Errorf("server span = %+v, want it to continue the trace", server)
+	}
+	if server.Status.Code != 2 {
+		t.Errorf("server span status = %+v, want an error", server.Status)
+	}
+	if child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID {
+		t.Errorf("child span = %+v, want it a child of %s", child, server.SpanID)
+	}
+	if len(child.Attributes) != 1 || child.Attributes[0].Value["intValue"] != "3" {
+		t.Errorf("child span attributes = %+v", child.Attributes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) != 1 || c.requests[0].ResourceSpans[0].Resource.Attributes[0].Value["stringValue"] != "accounts" {
+		t.Errorf("requests = %+v, want one for the service", c.requests)
+	}
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	c := collector{status: http.StatusServiceUnavailable}
+	ts := httptest.NewServer(&c)
+	defer ts.Close()
+
+	e := NewOTLPExporter(ts.URL, "accounts", nil)
+	err := e.ExportSpans(context.Background(), []SpanData{{TraceID: "t", SpanID: "s", Name: "span", Start: time.Now(), End: time.Now()}})
+	if err == nil {
+		t.Error("ExportSpans succeeded, want an error")
+	}
+}
+
+func TestTracerExportError(t *testing.T) {
+	c := collector{status: http.StatusServiceUnavailable}
+	ts := httptest.NewServer(&c)
+	defer ts.Close()
+
+	var tl testLog
+	reg := prometheus.NewRegistry()
+	tracer := NewTracer(TracerConfig{Exporter: NewOTLPExporter(ts.URL, "accounts", nil), Logger: tl.logger(), Registerer: reg})
+	defer tracer.Shutdown(context.Background())
+
+	for i := 0; i < 2; i++ {
+		tracer.start("span", SpanKindInternal, nil, "", "", false).End()
+	}
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure is logged, and the spans counted as dropped
+	if entries := tl.entries(); len(entries) != 1 || entries[0].Level != "warn" || entries[0].Msg != "exporting spans failed" {
+		t.Errorf("entries = %+v, want one warning", entries)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped float64
+	for _, mf := range mfs {
+		if mf.GetName() == "api_trace_spans_dropped_total" {
+			dropped = mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	if dropped != 2 {
+		t.Errorf("dropped = %v, want 2", dropped)
+	}
+}
+
+func TestTracerShutdown(t *testing.T) {
+	c := collector{}
+	ts := httptest.NewServer(&c)
+	defer ts.Close()
+
+	// Spans may end while, and after, the tracer shuts down
+	tracer := NewTracer(TracerConfig{Exporter: NewOTLPExporter(ts.URL, "accounts", nil), BatchSize: 4, Registerer: prometheus.NewRegistry()})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tracer.start("span", SpanKindInternal, nil, "", "", false).End()
+			}
+		}()
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Errorf("Flush after Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,491 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// keySpan is how the current span is stored and retrieved
+const keySpan ctxKey = 4
+
+// SpanKind describes the relationship of a span to its trace.
+type SpanKind int
+
+// The kinds of span, as defined by OpenTelemetry.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanData is a completed span, as passed to a SpanExporter.
+type SpanData struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	// The error the span ended with, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// SpanExporter sends completed spans to a tracing backend.
+type SpanExporter interface {
+	// ExportSpans exports a batch of spans.
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	// Shutdown releases any resources held by the exporter.
+	Shutdown(ctx context.Context) error
+}
+
+// Sampler decides whether a new trace is recorded.
+type Sampler interface {
+	// Sample returns whether to record the span starting a trace with the
+	// given id, in this service. If the trace was propagated by the client,
+	// remote is true and sampled is the client's decision.
+	Sample(traceID string, remote, sampled bool) bool
+}
+
+// samplerFunc adapts a function to a Sampler
+type samplerFunc func(traceID string, remote, sampled bool) bool
+
+// Sample implements Sampler
+func (f samplerFunc) Sample(traceID string, remote, sampled bool) bool {
+	return f(traceID, remote, sampled)
+}
+
+// AlwaysSample returns a Sampler that records every trace.
+func AlwaysSample() Sampler {
+	return samplerFunc(func(string, bool, bool) bool { return true })
+}
+
+// NeverSample returns a Sampler that records no traces.
+func NeverSample() Sampler {
+	return samplerFunc(func(string, bool, bool) bool { return false })
+}
+
+// RatioSample returns a Sampler that records the given fraction of traces.
+// The decision is derived from the trace id, so every service using the same
+// ratio makes the same decision.
+func RatioSample(ratio float64) Sampler {
+	return samplerFunc(func(traceID string, _, _ bool) bool {
+		if ratio >= 1 {
+			return true
+		}
+		b, err := hex.DecodeString(traceID)
+		if err != nil || len(b) != 16 {
+			return false
+		}
+		// Compare the last 8 bytes of the id against the ratio, as in OpenTelemetry
+		return binary.BigEndian.Uint64(b[8:])>>1 < uint64(ratio*(1<<63))
+	})
+}
+
+// ParentBasedSample returns a Sampler that follows the decision of the client
+// for propagated traces, and uses root for traces starting here.
+func ParentBasedSample(root Sampler) Sampler {
+	return samplerFunc(func(traceID string, remote, sampled bool) bool {
+		if remote {
+			return sampled
+		}
+		return root.Sample(traceID, remote, sampled)
+	})
+}
+
+// TracerConfig configures a Tracer.
+type TracerConfig struct {
+	// Decides which traces are recorded. Defaults to
+	// ParentBasedSample(AlwaysSample()).
+	Sampler Sampler
+	// Where recorded spans are sent. If nil, spans are not exported.
+	Exporter SpanExporter
+	// The maximum number of spans exported at once. Defaults to 512.
+	BatchSize int
+	// How often spans are exported, if a batch hasn't filled. Defaults to 5s.
+	FlushInterval time.Duration
+	// Where failures to export spans are logged. Defaults to a no-op logger.
+	Logger *zap.SugaredLogger
+	// Where the count of dropped spans is registered. Defaults to
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// Tracer records spans, exporting them in batches in the background.
+type Tracer struct {
+	sampler  Sampler
+	exporter SpanExporter
+	size     int
+	interval time.Duration
+	logger   *zap.SugaredLogger
+	dropped  prometheus.Counter
+
+	spans chan SpanData
+	flush chan chan struct{}
+	done  chan struct{}
+
+	// mu guards closed, which is set when spans is closed by Shutdown, so
+	// spans aren't sent on it after
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTracer returns a Tracer with the given config. Shutdown must be called
+// to export any remaining spans before the process exits.
+func NewTracer(cfg TracerConfig) *Tracer {
+	t := Tracer{
+		sampler:  cfg.Sampler,
+		exporter: cfg.Exporter,
+		size:     cfg.BatchSize,
+		interval: cfg.FlushInterval,
+		logger:   cfg.Logger,
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "api_trace_spans_dropped_total",
+			Help: "Spans dropped because the export queue was full, or exporting them failed",
+		}),
+	}
+	if t.sampler == nil {
+		t.sampler = ParentBasedSample(AlwaysSample())
+	}
+	if t.size <= 0 {
+		t.size = 512
+	}
+	if t.interval <= 0 {
+		t.interval = 5 * time.Second
+	}
+	if t.logger == nil {
+		t.logger = zap.NewNop().Sugar()
+	}
+	t.spans = make(chan SpanData, 4*t.size)
+
+	reg := cfg.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	reg.MustRegister(t.dropped)
+
+	go t.run()
+
+	return &t
+}
+
+// run exports spans in batches, until the tracer is shut down.
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.size)
+	export := func() {
+		if len(batch) > 0 && t.exporter != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+			if err := t.exporter.ExportSpans(ctx, batch); err != nil {
+				t.logger.Warnw("exporting spans failed", "spans", len(batch), "error", err)
+				t.dropped.Add(float64(len(batch)))
+			}
+			cancel()
+		}
+		batch = make([]SpanData, 0, t.size)
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= t.size {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			// Drain any spans already ended before exporting, in batches
+			for n := len(t.spans); n > 0; n-- {
+				if s, ok := <-t.spans; ok {
+					batch = append(batch, s)
+					if len(batch) >= t.size {
+						export()
+					}
+				}
+			}
+			export()
+			close(flushed)
+		}
+	}
+}
+
+// Shutdown exports any remaining spans, then shuts down the exporter. Spans
+// ended after Shutdown are discarded.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+// Flush exports all spans ended so far.
+func (t *Tracer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// export queues a span to be exported. If the queue is full the span is
+// dropped, rather than slow down the request.
+func (t *Tracer) export(s SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.dropped.Inc()
+	}
+}
+
+// start starts a span. If parent is nil, the span starts a new trace, or
+// continues the trace propagated by a client if traceID is set.
+func (t *Tracer) start(name string, kind SpanKind, parent *Span, traceID, parentSpanID string, remoteSampled bool) *Span {
+	s := Span{
+		tracer: t,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       newID(8),
+			ParentSpanID: parentSpanID,
+			Name:         name,
+			Kind:         kind,
+			Start:        time.Now(),
+		},
+	}
+
+	switch {
+	case parent != nil:
+		// Children follow the decision made for their trace
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+		s.sampled = parent.sampled
+	case traceID != "":
+		s.sampled = t.sampler.Sample(traceID, true, remoteSampled)
+	default:
+		s.data.TraceID = newID(16)
+		s.sampled = t.sampler.Sample(s.data.TraceID, false, false)
+	}
+
+	return &s
+}
+
+// Span is an operation within a trace. A nil Span is valid, and records
+// nothing, so callers need not check whether tracing is enabled.
+type Span struct {
+	tracer  *Tracer
+	sampled bool
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// StartSpan starts a span that is a child of the span in ctx, i.e. the server
+// span of a request traced by TraceMW. The returned context holds the new span.
+// If ctx holds no span, nothing is recorded and a nil Span is returned. The
+// span must be ended by calling End.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := parent.tracer.start(name, SpanKindInternal, parent, "", "", false)
+	return context.WithValue(ctx, keySpan, s), s
+}
+
+// SpanFromContext returns the span held by ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(keySpan).(*Span)
+	return s
+}
+
+// TraceID returns the id of the span's trace.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.data.TraceID
+}
+
+// SpanID returns the id of the span.
+func (s *Span) SpanID() string {
+	if s == nil {
+		return ""
+	}
+	return s.data.SpanID
+}
+
+// Sampled returns whether the span is recorded.
+func (s *Span) Sampled() bool {
+	return s != nil && s.sampled
+}
+
+// SetAttribute sets an attribute describing the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.Sampled() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The span may already be being exported
+	if s.ended {
+		return
+	}
+
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed with the given error.
+func (s *Span) SetError(err error) {
+	if !s.Sampled() || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ended {
+		s.data.Error = err.Error()
+	}
+}
+
+// End ends the span, queueing it to be exported if it is recorded. Calls after
+// the first have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+
+	if s.sampled {
+		s.tracer.export(s.data)
+	}
+}
+
+// TraceMW returns a middleware that records a server span for every request,
+// named after the route of the request. Trace context propagated by the
+// client, using W3C traceparent or X-Cloud-Trace-Context headers, is
+// continued. The span's trace context is set on the request's Details, so it
+// appears in logs, and the span is added to the request context for StartSpan.
+func TraceMW(t *Tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		var h http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			d := getDetails(r)
+
+			name := r.URL.Path
+			if d != nil {
+				name = d.RequestPath
+			}
+
+			traceID, parentSpanID, sampled := traceFromRequest(r)
+			s := t.start(name, SpanKindServer, nil, traceID, parentSpanID, sampled)
+			s.SetAttribute("http.method", r.Method)
+			s.SetAttribute("http.route", name)
+			s.SetAttribute("http.target", r.URL.Path)
+
+			if d != nil {
+				d.TraceID, d.SpanID, d.TraceSampled = s.TraceID(), s.SpanID(), s.Sampled()
+				s.SetAttribute("request_id", d.RequestID)
+			}
+
+			defer func() {
+				if d != nil {
+					s.SetAttribute("http.status_code", d.StatusCode)
+					if d.StatusCode >= 500 {
+						s.SetError(fmt.Errorf("%d %s", d.StatusCode, http.StatusText(d.StatusCode)))
+					}
+				}
+				s.End()
+			}()
+
+			// Call the wrapped handler, with the span in its context
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keySpan, s)))
+		}
+		return h
+	}
+}
+
+// InjectTrace adds the trace context of the span in ctx to the headers of an
+// outgoing request, using the W3C traceparent header.
+func InjectTrace(ctx context.Context, h http.Header) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		return
+	}
+
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	h.Set("traceparent", "00-"+s.data.TraceID+"-"+s.data.SpanID+"-"+flags)
+}
+
+// newID returns a random, hex encoded, id of n bytes.
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memoryExporter is a SpanExporter recording the spans it exports.
+type memoryExporter struct {
+	mu      sync.Mutex
+	batches [][]SpanData
+}
+
+// ExportSpans implements SpanExporter
+func (e *memoryExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.batches = append(e.batches, append([]SpanData{}, spans...))
+	return nil
+}
+
+// Shutdown implements SpanExporter
+func (e *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// spans returns the spans exported, in order.
+func (e *memoryExporter) spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var spans []SpanData
+	for _, b := range e.batches {
+		spans = append(spans, b...)
+	}
+	return spans
+}
+
+func TestSamplers(t *testing.T) {
+	// An id whose last 8 bytes are half of the maximum
+	const half = "4bf92f3577b34da67fffffffffffffff"
+	tests := []struct {
+		name            string
+		sampler         Sampler
+		traceID         string
+		remote, sampled bool
+		want            bool
+	}{
+		{name: "always", sampler: AlwaysSample(), want: true},
+		{name: "never", sampler: NeverSample(), want: false},
+		{name: "ratio one", sampler: RatioSample(1), traceID: half, want: true},
+		{name: "ratio zero", sampler: RatioSample(0), traceID: half, want: false},
+		{name: "ratio below", sampler: RatioSample(0.6), traceID: half, want: true},
+		{name: "ratio above", sampler: RatioSample(0.4), traceID: half, want: false},
+		{name: "ratio invalid id", sampler: RatioSample(0.5), traceID: "nope", want: false},
+		{name: "parent sampled", sampler: ParentBasedSample(NeverSample()), remote: true, sampled: true, want: true},
+		{name: "parent not sampled", sampler: ParentBasedSample(AlwaysSample()), remote: true, sampled: false, want: false},
+		{name: "parent root", sampler: ParentBasedSample(AlwaysSample()), want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.sampler.Sample(tt.traceID, tt.remote, tt.sampled); got != tt.want {
+			t.Errorf("%s: Sample() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	// Spans can't be started without a parent, and nil spans record nothing
+	ctx, s := StartSpan(context.Background(), "orphan")
+	if s != nil || SpanFromContext(ctx) != nil {
+		t.Fatalf("span = %v, want nil", s)
+	}
+	s.SetAttribute("k", "v")
+	s.SetError(errors.New("failed"))
+	s.End()
+	if s.TraceID() != "" || s.SpanID() != "" || s.Sampled() {
+		t.Error("nil span has a trace")
+	}
+
+	h := make(http.Header)
+	InjectTrace(ctx, h)
+	if len(h) != 0 {
+		t.Errorf("headers = %v, want none", h)
+	}
+}
+
+func TestTraceMW(t *testing.T) {
+	var e memoryExporter
+	tracer := NewTracer(TracerConfig{Exporter: &e, BatchSize: 2, Registerer: prometheus.NewRegistry()})
+
+	var details Details
+	var injected http.Header
+	endpoint := Endpoint{
+		Method: http.MethodPost,
+		Path:   "/accounts/:id",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			details = *getDetails(r)
+
+			ctx, s := StartSpan(r.Context(), "db.query")
+			s.SetError(errors.New("no rows"))
+			s.End()
+			s.End()
+			s.SetAttribute("late", true)
+
+			injected = make(http.Header)
+			InjectTrace(ctx, injected)
+			RespondError(w, r, http.StatusInternalServerError)
+		}),
+		Middlewares: []Middleware{TraceMW(tracer)},
+	}
+	handleTest(httptest.NewRequest(http.MethodPost, "/accounts/1", nil), endpoint)
+
+	// Requests that aren't sampled by their client aren't recorded
+	r := httptest.NewRequest(http.MethodPost, "/accounts/2", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handleTest(r, endpoint)
+	if details.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || details.TraceSampled {
+		t.Errorf("details trace = %s, sampled %t, want the client's unsampled trace", details.TraceID, details.TraceSampled)
+	}
+	if got := injected.Get("traceparent"); len(got) != 55 || got[:36] != "00-4bf92f3577b34da6a3ce929d0e0e4736-" || got[53:] != "00" {
+		t.Errorf("injected traceparent = %q", got)
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := e.spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name != "/accounts/:id" || server.Kind != SpanKindServer || server.ParentSpanID != "" || server.Error != "500 Internal Server Error" {
+		t.Errorf("server span = %+v", server)
+	}
+	if server.Attributes["http.method"] != http.MethodPost || server.Attributes["http.status_code"] != http.StatusInternalServerError || server.Attributes["request_id"] == "" {
+		t.Errorf("server span attributes = %v", server.Attributes)
+	}
+	if child.Name != "db.query" || child.Kind != SpanKindInternal || child.TraceID != server.TraceID || child.ParentSpanID != server.SpanID || child.Error != "no rows" {
+		t.Errorf("child span = %+v", child)
+	}
+	if _, ok := child.Attributes["late"]; ok {
+		t.Error("attribute set after End was recorded")
+	}
+}
+
+func TestTracerFlush(t *testing.T) {
+	var e memoryExporter
+	tracer := NewTracer(TracerConfig{Exporter: &e, BatchSize: 3, Registerer: prometheus.NewRegistry()})
+	defer tracer.Shutdown(context.Background())
+
+	for i := 0; i < 4; i++ {
+		tracer.start("span", SpanKindInternal, nil, "", "", false).End()
+	}
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans are exported in batches of at most BatchSize
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.batches) != 2 || len(e.batches[0]) != 3 || len(e.batches[1]) != 1 {
+		t.Errorf("exported batches of %v, want 3 then 1", e.batches)
+	}
+}
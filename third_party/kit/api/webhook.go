@@ -0,0 +1,920 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/ksuid"
+	"go.uber.org/zap"
+)
+
+// The headers of webhook deliveries
+const (
+	// The ID of the delivery, the same for every attempt, so receivers can
+	// ignore deliveries they have already had.
+	HeaderWebhookID = "Webhook-Id"
+	// The time the delivery was attempted, in seconds since the Unix epoch.
+	HeaderWebhookTimestamp = "Webhook-Timestamp"
+	// The signature of the delivery, see SignWebhook.
+	HeaderWebhookSignature = "Webhook-Signature"
+)
+
+// ErrSubscriptionNotFound is returned by a WebhookStore for subscriptions it
+// doesn't have.
+var ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+
+// ErrInvalidSignature is returned by VerifyWebhook for deliveries that
+// weren't signed with the secret, or were signed outside the tolerance.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// WebhookSubscription is a subscription to deliveries of events to a URL.
+type WebhookSubscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// The events delivered. Empty means every event.
+	Events []string `json:"events,omitempty"`
+	// The secret deliveries are signed with. It is only responded with when
+	// the subscription is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants returns whether the subscription wants the given event delivered.
+func (s WebhookSubscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeliveryStatus is the status of a webhook delivery.
+type WebhookDeliveryStatus string
+
+// The statuses of webhook deliveries
+const (
+	// The delivery is waiting to be attempted, or retried.
+	WebhookPending WebhookDeliveryStatus = "pending"
+	// The delivery was received with a 2xx.
+	WebhookDelivered WebhookDeliveryStatus = "delivered"
+	// Every attempt of the delivery failed, and it won't be retried.
+	WebhookDead WebhookDeliveryStatus = "dead"
+)
+
+// WebhookDelivery is the delivery of an event to a subscription.
+type WebhookDelivery struct {
+	ID             string                `json:"id"`
+	SubscriptionID string                `json:"subscription_id"`
+	Event          string                `json:"event"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	// The body delivered.
+	Payload json.RawMessage `json:"payload"`
+	// The attempts made so far, oldest first.
+	Attempts []WebhookAttempt `json:"attempts"`
+	// When the delivery is next attempted, if it is pending.
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// WebhookAttempt is an attempt to deliver a webhook.
+type WebhookAttempt struct {
+	At time.Time `json:"at"`
+	// The status the receiver responded with, or zero if it didn't respond.
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// WebhookStore stores webhook subscriptions and their deliveries.
+type WebhookStore interface {
+	CreateSubscription(ctx context.Context, s WebhookSubscription) error
+	// GetSubscription returns the subscription with the given ID, or
+	// ErrSubscriptionNotFound.
+	GetSubscription(ctx context.Context, id string) (WebhookSubscription, error)
+	ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+	// DeleteSubscription deletes the subscription with the given ID, or
+	// returns ErrSubscriptionNotFound.
+	DeleteSubscription(ctx context.Context, id string) error
+
+	CreateDelivery(ctx context.Context, d WebhookDelivery) error
+	UpdateDelivery(ctx context.Context, d WebhookDelivery) error
+	// ListDeliveries returns the deliveries to a subscription, newest first.
+	ListDeliveries(ctx context.Context, subscriptionID string) ([]WebhookDelivery, error)
+	// ClaimDueDeliveries claims up to limit pending deliveries that are due to
+	// be attempted at now, by moving their NextAttemptAt to until, returning
+	// them. Claiming must be atomic, so a delivery is only claimed by one
+	// instance sharing the store, and is claimed again once until has passed,
+	// i.e. if the instance attempting it stopped.
+	ClaimDueDeliveries(ctx context.Context, now, until time.Time, limit int) ([]WebhookDelivery, error)
+}
+
+// WebhookOptions configures webhook delivery.
+type WebhookOptions struct {
+	// The events that can be subscribed to. Empty means any.
+	Events []string
+	// The client deliveries are made with. Nil means a client with a 10s
+	// timeout. Redirects are never followed, and unless AllowInsecure is set,
+	// deliveries are only made to public addresses, checked as they are
+	// dialled, which needs the client's Transport to be nil or an
+	// *http.Transport. Deliveries aren't made through a proxy.
+	Client *http.Client
+	// Whether subscriptions may be to http URLs, and deliveries made to
+	// private, loopback and link-local addresses, i.e. for development.
+	// Otherwise they are rejected, so subscribers can't reach internal
+	// services.
+	AllowInsecure bool
+	// The number of attempts of a delivery before it is dead. Zero means 8.
+	MaxAttempts int
+	// The delay before the first retry, doubling for each one after. Zero
+	// means 10s.
+	InitialBackoff time.Duration
+	// The longest delay between retries. Zero means 1h.
+	MaxBackoff time.Duration
+	// The maximum number of deliveries attempted at once. Zero means 10.
+	Concurrency int
+	// How often to check for deliveries that are due. Zero means 1s.
+	PollInterval time.Duration
+	// How long a delivery is claimed for by the instance attempting it, after
+	// which another instance may attempt it. It should be longer than the
+	// client's timeout. Zero means 1m.
+	ClaimTimeout time.Duration
+	// Middlewares applied to the subscription endpoints, i.e. access control.
+	Middlewares []Middleware
+	// The registerer the delivery metrics are registered with. Nil means
+	// prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// Webhooks delivers events to the URLs subscribed to them, and is an API to
+// manage subscriptions on /webhooks, and see their deliveries on
+// /webhooks/:id/deliveries.
+//
+// Deliveries are POSTed as JSON, signed with the subscription's secret, see
+// SignWebhook. Deliveries that aren't responded to with a 2xx are retried
+// with exponential backoff, until they are dead.
+type Webhooks struct {
+	store  WebhookStore
+	logger *zap.SugaredLogger
+	opts   WebhookOptions
+
+	// wake is signalled when events are published, so they are delivered
+	// without waiting to poll.
+	wake chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]bool
+
+	duration *prometheus.HistogramVec
+	dead     *prometheus.CounterVec
+}
+
+// NewWebhooks returns Webhooks storing subscriptions and deliveries in the
+// given store. Deliveries are made by Run, which must be called for events to
+// be delivered.
+func NewWebhooks(store WebhookStore, logger *zap.SugaredLogger, opts WebhookOptions) *Webhooks {
+	opts.Client = webhookClient(opts.Client, opts.AllowInsecure)
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 8
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 10 * time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Hour
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.ClaimTimeout <= 0 {
+		opts.ClaimTimeout = time.Minute
+	}
+	if opts.Registerer == nil {
+		opts.Registerer = prometheus.DefaultRegisterer
+	}
+
+	wh := Webhooks{
+		store:    store,
+		logger:   logger,
+		opts:     opts,
+		wake:     make(chan struct{}, 1),
+		inflight: make(map[string]bool),
+		// Observe the latency of delivery attempts, by the 'group' of the
+		// status the receiver responded with, or "error" if it didn't.
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "api_webhook_latency_seconds",
+			Help:    "Webhook delivery attempt latency distributions",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"event", "status"}),
+		dead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "api_webhook_dead_total",
+			Help: "Webhook deliveries that failed every attempt",
+		}, []string{"event"}),
+	}
+	opts.Registerer.MustRegister(wh.duration, wh.dead)
+
+	return &wh
+}
+
+// Publish queues the delivery of an event, with the given data, to every
+// subscription to it. The body of each delivery is
+//
+//	{"id": "<delivery id>", "event": "<event>", "created_at": "<time>", "data": <data>}
+func (wh *Webhooks) Publish(ctx context.Context, event string, data interface{}) error {
+	subs, err := wh.store.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, s := range subs {
+		if !s.wants(event) {
+			continue
+		}
+
+		id := ksuid.New().String()
+		payload, err := json.Marshal(struct {
+			ID        string      `json:"id"`
+			Event     string      `json:"event"`
+			CreatedAt time.Time   `json:"created_at"`
+			Data      interface{} `json:"data"`
+		}{id, event, now, data})
+		if err != nil {
+			return err
+		}
+
+		d := WebhookDelivery{
+			ID:             id,
+			SubscriptionID: s.ID,
+			Event:          event,
+			Status:         WebhookPending,
+			Payload:        payload,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		}
+		if err := wh.store.CreateDelivery(ctx, d); err != nil {
+			return err
+		}
+	}
+
+	// Deliver now, rather than at the next poll
+	select {
+	case wh.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run attempts deliveries as they are due, until ctx is done, then waits for
+// the attempts in progress to finish. Instances sharing a store each claim
+// the deliveries they attempt, so each delivery is attempted by one of them.
+func (wh *Webhooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, wh.opts.Concurrency)
+	ticker := time.NewTicker(wh.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wh.wake:
+		}
+
+		wh.deliverDue(ctx, sem, &wg)
+	}
+}
+
+// deliverDue claims and attempts deliveries, at most as many at once as sem
+// allows, until none are due or ctx is done.
+func (wh *Webhooks) deliverDue(ctx context.Context, sem chan struct{}, wg *sync.WaitGroup) {
+	for {
+		// Wait for an attempt to finish, if as many as allowed are in progress
+		select {
+		case sem <- struct{}{}:
+			<-sem
+		case <-ctx.Done():
+			return
+		}
+
+		// Only claim the deliveries that can be attempted now, so their claims
+		// don't run out while they wait
+		limit := cap(sem) - len(sem)
+		now := time.Now()
+		due, err := wh.store.ClaimDueDeliveries(ctx, now, now.Add(wh.opts.ClaimTimeout), limit)
+		if err != nil {
+			wh.logger.Errorw("webhook deliveries could not be claimed", "error", err)
+			return
+		}
+
+		for _, d := range due {
+			// Don't attempt a delivery that is still being attempted, because
+			// its claim ran out
+			wh.mu.Lock()
+			if wh.inflight[d.ID] {
+				wh.mu.Unlock()
+				continue
+			}
+			wh.inflight[d.ID] = true
+			wh.mu.Unlock()
+
+			// Only this goroutine adds to sem, so there is room
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(d WebhookDelivery) {
+				defer func() {
+					wh.mu.Lock()
+					delete(wh.inflight, d.ID)
+					wh.mu.Unlock()
+					<-sem
+					wg.Done()
+				}()
+				wh.attempt(d)
+			}(d)
+		}
+
+		if len(due) < limit {
+			return
+		}
+	}
+}
+
+// attempt attempts a delivery, storing the outcome.
+func (wh *Webhooks) attempt(d WebhookDelivery) {
+	// The attempt isn't cut short by Run stopping, so its outcome is stored
+	ctx := context.Background()
+
+	s, err := wh.store.GetSubscription(ctx, d.SubscriptionID)
+	if err == ErrSubscriptionNotFound {
+		// The subscription was deleted, so there's nowhere to deliver to
+		d.Status = WebhookDead
+		d.Attempts = append(d.Attempts, WebhookAttempt{At: time.Now().UTC(), Error: "subscription deleted"})
+		wh.logger.Infow("webhook delivery dropped, subscription deleted", "delivery", d.ID, "subscription", d.SubscriptionID, "event", d.Event)
+		wh.update(ctx, d)
+		return
+	}
+
+	start := time.Now()
+	var status int
+	if err != nil {
+		// Retry later, as if the delivery failed, rather than at every poll
+		err = fmt.Errorf("subscription could not be read: %w", err)
+	} else {
+		status, err = wh.send(ctx, s, d, start)
+
+		statusGroup := "error"
+		if status > 0 {
+			statusGroup = fmt.Sprintf("%dXX", status/100)
+		}
+		wh.duration.WithLabelValues(d.Event, statusGroup).Observe(time.Since(start).Seconds())
+	}
+
+	a := WebhookAttempt{
+		At:         start.UTC(),
+		StatusCode: status,
+		Duration:   time.Since(start),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	} else if status/100 != 2 {
+		a.Error = http.StatusText(status)
+	}
+	d.Attempts = append(d.Attempts, a)
+
+	kv := []interface{}{
+		"delivery", d.ID,
+		"subscription", d.SubscriptionID,
+		"event", d.Event,
+		"attempt", len(d.Attempts),
+		"status", status,
+		"duration", a.Duration,
+	}
+	if a.Error != "" {
+		kv = append(kv, "error", a.Error)
+	}
+
+	switch {
+	case a.Error == "":
+		d.Status = WebhookDelivered
+		wh.logger.Infow("webhook delivered", kv...)
+	case len(d.Attempts) >= wh.opts.MaxAttempts:
+		d.Status = WebhookDead
+		wh.dead.WithLabelValues(d.Event).Inc()
+		wh.logger.Errorw("webhook delivery dead, every attempt failed", kv...)
+	default:
+		d.NextAttemptAt = start.Add(wh.backoff(len(d.Attempts))).UTC()
+		wh.logger.Warnw("webhook delivery attempt failed", append(kv, "retry_at", d.NextAttemptAt)...)
+	}
+
+	wh.update(ctx, d)
+}
+
+// send makes a delivery to a subscription, returning the status the receiver
+// responded with.
+func (wh *Webhooks) send(ctx context.Context, s WebhookSubscription, d WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookID, d.ID)
+	req.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderWebhookSignature, SignWebhook(s.Secret, now, d.Payload))
+
+	resp, err := wh.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read some of the body, so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return resp.StatusCode, nil
+}
+
+// webhookClient returns a copy of the client deliveries are made with, that
+// doesn't follow redirects, and unless insecure is set, only dials public
+// addresses.
+func webhookClient(c *http.Client, insecure bool) *http.Client {
+	client := http.Client{Timeout: 10 * time.Second}
+	if c != nil {
+		client = *c
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if insecure {
+		return &client
+	}
+
+	t, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		t, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return &client
+	}
+	t = t.Clone()
+	t.Proxy = nil
+	dialer := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Check the address once it is resolved, so a name can't resolve to
+		// an internal address
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicIP(net.ParseIP(host)) {
+				return fmt.Errorf("webhook address %s not allowed", host)
+			}
+			return nil
+		},
+	}
+	t.DialContext = dialer.DialContext
+	client.Transport = t
+	return &client
+}
+
+// privateNetworks are the networks of addresses that aren't public, besides
+// loopback, link-local and multicast addresses.
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"fc00::/7",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicIP returns whether ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff returns the delay before retrying a delivery that has had the given
+// number of attempts.
+func (wh *Webhooks) backoff(attempts int) time.Duration {
+	delay := wh.opts.InitialBackoff
+	for i := 1; i < attempts && delay < wh.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > wh.opts.MaxBackoff {
+		delay = wh.opts.MaxBackoff
+	}
+	return delay
+}
+
+// update stores a delivery, logging if it can't be.
+func (wh *Webhooks) update(ctx context.Context, d WebhookDelivery) {
+	if err := wh.store.UpdateDelivery(ctx, d); err != nil {
+		wh.logger.Errorw("webhook delivery could not be updated", "delivery", d.ID, "error", err)
+	}
+}
+
+// SignWebhook returns the signature of a webhook delivery with the given body,
+// made at the given time, as sent in the Webhook-Signature header. It is
+// "v1=" followed by the hex encoded HMAC-SHA256, keyed with the secret, of the
+// timestamp in seconds, a ".", and the body.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook verifies the signature of a received webhook delivery, whose
+// body is given, against the secret of its subscription. Deliveries with a
+// timestamp further than tolerance from now are rejected, so they can't be
+// replayed.
+func VerifyWebhook(r *http.Request, body []byte, secret string, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderWebhookTimestamp), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	timestamp := time.Unix(ts, 0)
+	if d := time.Since(timestamp); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := SignWebhook(secret, timestamp, body)
+	// There may be several signatures, i.e. while the secret is rotated
+	for _, sig := range strings.Split(r.Header.Get(HeaderWebhookSignature), ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(sig)), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Endpoints implements API
+func (wh *Webhooks) Endpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Method:      http.MethodPost,
+			Path:        "/webhooks",
+			Handler:     http.HandlerFunc(wh.handleCreate),
+			Middlewares: wh.opts.Middlewares,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/webhooks",
+			Handler:     http.HandlerFunc(wh.handleList),
+			Middlewares: wh.opts.Middlewares,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/webhooks/:id",
+			Handler:     http.HandlerFunc(wh.handleGet),
+			Middlewares: wh.opts.Middlewares,
+		},
+		{
+			Method:      http.MethodDelete,
+			Path:        "/webhooks/:id",
+			Handler:     http.HandlerFunc(wh.handleDelete),
+			Middlewares: wh.opts.Middlewares,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/webhooks/:id/deliveries",
+			Handler:     http.HandlerFunc(wh.handleDeliveries),
+			Middlewares: wh.opts.Middlewares,
+		},
+	}
+}
+
+// handleCreate creates a subscription, responding with it, including its
+// secret. If a secret isn't given, one is generated.
+func (wh *Webhooks) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var s WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		Respond(w, r, http.StatusBadRequest, ErrorBody{Msg: "Invalid subscription: " + err.Error()})
+		return
+	}
+
+	if err := wh.validURL(s.URL); err != nil {
+		Respond(w, r, http.StatusBadRequest, ErrorBody{Msg: "Invalid subscription: " + err.Error()})
+		return
+	}
+	if unknown := wh.unknownEvents(s.Events); len(unknown) > 0 {
+		Respond(w, r, http.StatusBadRequest, InvalidFieldsBody{Msg: "Unknown events", Invalid: unknown, Valid: wh.opts.Events})
+		return
+	}
+
+	s.ID = ksuid.New().String()
+	s.CreatedAt = time.Now().UTC()
+	if s.Secret == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			Logger(r.Context()).Errorw("webhook secret could not be generated", "error", err)
+			RespondError(w, r, http.StatusInternalServerError)
+			return
+		}
+		s.Secret = "whsec_" + hex.EncodeToString(b)
+	}
+
+	if err := wh.store.CreateSubscription(r.Context(), s); err != nil {
+		Logger(r.Context()).Errorw("webhook subscription could not be created", "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/webhooks/"+s.ID)
+	Respond(w, r, http.StatusCreated, s)
+}
+
+// validURL returns an error if deliveries can't be made to the URL. Only https
+// URLs are valid, unless AllowInsecure is set, and those whose host is an
+// address must be public. Hosts that are names are checked when dialled.
+func (wh *Webhooks) validURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return errors.New("url must be an absolute https URL")
+	}
+	if wh.opts.AllowInsecure {
+		return nil
+	}
+	if u.Scheme != "https" {
+		return errors.New("url must be an absolute https URL")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return errors.New("url must not be to a private address")
+	}
+	return nil
+}
+
+// unknownEvents returns the events that can't be subscribed to.
+func (wh *Webhooks) unknownEvents(events []string) []string {
+	if len(wh.opts.Events) == 0 {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, e := range wh.opts.Events {
+		known[e] = true
+	}
+	var unknown []string
+	for _, e := range events {
+		if !known[e] {
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+// handleList responds with every subscription, without their secrets.
+func (wh *Webhooks) handleList(w http.ResponseWriter, r *http.Request) {
+	subs, err := wh.store.ListSubscriptions(r.Context())
+	if err != nil {
+		Logger(r.Context()).Errorw("webhook subscriptions could not be read", "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	if subs == nil {
+		subs = []WebhookSubscription{}
+	}
+	Respond(w, r, http.StatusOK, subs)
+}
+
+// handleGet responds with a subscription, without its secret.
+func (wh *Webhooks) handleGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := wh.get(w, r)
+	if !ok {
+		return
+	}
+	s.Secret = ""
+	Respond(w, r, http.StatusOK, s)
+}
+
+// handleDelete deletes a subscription. Its pending deliveries are dead.
+func (wh *Webhooks) handleDelete(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	err := wh.store.DeleteSubscription(r.Context(), id)
+	if err == ErrSubscriptionNotFound {
+		RespondError(w, r, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Logger(r.Context()).Errorw("webhook subscription could not be deleted", "subscription", id, "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+	Respond(w, r, http.StatusNoContent, nil)
+}
+
+// handleDeliveries responds with the deliveries to a subscription, newest
+// first.
+func (wh *Webhooks) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	s, ok := wh.get(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := wh.store.ListDeliveries(r.Context(), s.ID)
+	if err != nil {
+		Logger(r.Context()).Errorw("webhook deliveries could not be read", "subscription", s.ID, "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	Respond(w, r, http.StatusOK, deliveries)
+}
+
+// get returns the subscription a request is for, responding with a 404 if
+// there isn't one.
+func (wh *Webhooks) get(w http.ResponseWriter, r *http.Request) (WebhookSubscription, bool) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	s, err := wh.store.GetSubscription(r.Context(), id)
+	if err == ErrSubscriptionNotFound {
+		RespondError(w, r, http.StatusNotFound)
+		return WebhookSubscription{}, false
+	}
+	if err != nil {
+		Logger(r.Context()).Errorw("webhook subscription could not be read", "subscription", id, "error", err)
+		RespondError(w, r, http.StatusInternalServerError)
+		return WebhookSubscription{}, false
+	}
+	return s, true
+}
+
+// MemoryWebhookStore is a WebhookStore that holds subscriptions and
+// deliveries in memory. Deliveries are forgotten once they are older than the
+// retention.
+type MemoryWebhookStore struct {
+	retention time.Duration
+
+	mu         sync.Mutex
+	subs       map[string]WebhookSubscription
+	deliveries map[string]WebhookDelivery
+}
+
+// NewMemoryWebhookStore returns a MemoryWebhookStore keeping deliveries that
+// aren't pending for the given duration. Zero means they are kept forever.
+func NewMemoryWebhookStore(retention time.Duration) *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		retention:  retention,
+		subs:       make(map[string]WebhookSubscription),
+		deliveries: make(map[string]WebhookDelivery),
+	}
+}
+
+// CreateSubscription implements WebhookStore
+func (s *MemoryWebhookStore) CreateSubscription(ctx context.Context, sub WebhookSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub.ID] = sub
+	return nil
+}
+
+// GetSubscription implements WebhookStore
+func (s *MemoryWebhookStore) GetSubscription(ctx context.Context, id string) (WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[id]
+	if !ok {
+		return WebhookSubscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// ListSubscriptions implements WebhookStore
+func (s *MemoryWebhookStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]WebhookSubscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// DeleteSubscription implements WebhookStore
+func (s *MemoryWebhookStore) DeleteSubscription(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[id]; !ok {
+		return ErrSubscriptionNotFound
+	}
+	delete(s.subs, id)
+	return nil
+}
+
+// CreateDelivery implements WebhookStore
+func (s *MemoryWebhookStore) CreateDelivery(ctx context.Context, d WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget old deliveries as new ones are created, so they don't grow forever
+	if s.retention > 0 {
+		for id, old := range s.deliveries {
+			if old.Status != WebhookPending && time.Since(old.CreatedAt) > s.retention {
+				delete(s.deliveries, id)
+			}
+		}
+	}
+
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+// UpdateDelivery implements WebhookStore
+func (s *MemoryWebhookStore) UpdateDelivery(ctx context.Context, d WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[d.ID]; !ok {
+		return fmt.Errorf("webhook delivery %s not found", d.ID)
+	}
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+// ListDeliveries implements WebhookStore
+func (s *MemoryWebhookStore) ListDeliveries(ctx context.Context, subscriptionID string) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deliveries []WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	// KSUIDs sort by time
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	return deliveries, nil
+}
+
+// ClaimDueDeliveries implements WebhookStore
+func (s *MemoryWebhookStore) ClaimDueDeliveries(ctx context.Context, now, until time.Time, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.Status == WebhookPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	// Attempt the longest waiting first
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].NextAttemptAt = until.UTC()
+		s.deliveries[due[i].ID] = due[i]
+	}
+	return due, nil
+}
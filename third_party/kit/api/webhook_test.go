@@ -0,0 +1,432 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// newTestWebhooks returns Webhooks with the given options, storing in memory.
+func newTestWebhooks(opts WebhookOptions) (*Webhooks, *MemoryWebhookStore) {
+	store := NewMemoryWebhookStore(0)
+	opts.Registerer = prometheus.NewRegistry()
+	return NewWebhooks(store, zap.NewNop().Sugar(), opts), store
+}
+
+// receiver is a webhook receiver, recording the deliveries it receives.
+type receiver struct {
+	mu       sync.Mutex
+	bodies   [][]byte
+	requests []*http.Request
+	status   int
+}
+
+// ServeHTTP implements http.Handler
+func (rv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.bodies = append(rv.bodies, b)
+	rv.requests = append(rv.requests, r)
+	if rv.status != 0 {
+		w.WriteHeader(rv.status)
+	}
+}
+
+// received returns the number of deliveries received.
+func (rv *receiver) received() int {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return len(rv.bodies)
+}
+
+// subscribe stores a subscription to url, with a pending delivery to it,
+// returning the delivery.
+func subscribe(t *testing.T, store *MemoryWebhookStore, url string) WebhookDelivery {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	if err := store.CreateSubscription(ctx, WebhookSubscription{ID: "sub", URL: url, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	d := WebhookDelivery{
+		ID:             "del",
+		SubscriptionID: "sub",
+		Event:          "account.created",
+		Status:         WebhookPending,
+		Payload:        []byte(`{"id":"del"}`),
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+	if err := store.CreateDelivery(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// delivery returns the stored delivery with the given ID.
+func delivery(t *testing.T, store *MemoryWebhookStore, id string) WebhookDelivery {
+	t.Helper()
+	deliveries, err := store.ListDeliveries(context.Background(), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	t.Fatalf("delivery %s not found", id)
+	return WebhookDelivery{}
+}
+
+func TestWebhookCreateURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		insecure bool
+		status   int
+	}{
+		{url: "https://example.com/hook", status: http.StatusCreated},
+		{url: "https://93.184.216.34/hook", status: http.StatusCreated},
+		{url: "http://example.com/hook", status: http.StatusBadRequest},
+		{url: "ftp://example.com/hook", status: http.StatusBadRequest},
+		{url: "/hook", status: http.StatusBadRequest},
+		{url: "https://127.0.0.1/hook", status: http.StatusBadRequest},
+		{url: "https://10.1.2.3/hook", status: http.StatusBadRequest},
+		{url: "https://169.254.169.254/latest/meta-data", status: http.StatusBadRequest},
+		{url: "https://[::1]/hook", status: http.StatusBadRequest},
+		{url: "https://[fd00::1]/hook", status: http.StatusBadRequest},
+		{url: "http://127.0.0.1/hook", insecure: true, status: http.StatusCreated},
+		{url: "ftp://127.0.0.1/hook", insecure: true, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		wh, _ := newTestWebhooks(WebhookOptions{AllowInsecure: tt.insecure})
+		r := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(`{"url":"`+tt.url+`"}`))
+		w := handleTest(r, wh.Endpoints()...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.url, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	rv := receiver{}
+	ts := httptest.NewTLSServer(&rv)
+	defer ts.Close()
+
+	// Names can resolve to private addresses, so they are checked when dialled
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	wh, store := newTestWebhooks(WebhookOptions{Client: ts.Client()})
+	d := subscribe(t, store, url)
+	wh.attempt(d)
+
+	d = delivery(t, store, d.ID)
+	if rv.received() != 0 {
+		t.Error("delivered to a private address")
+	}
+	if len(d.Attempts) != 1 || !strings.Contains(d.Attempts[0].Error, "not allowed") {
+		t.Errorf("attempts = %+v, want one that isn't allowed", d.Attempts)
+	}
+
+	// Unless insecure deliveries are allowed
+	wh, store = newTestWebhooks(WebhookOptions{Client: ts.Client(), AllowInsecure: true})
+	d = subscribe(t, store, ts.URL)
+	wh.attempt(d)
+
+	if d = delivery(t, store, d.ID); d.Status != WebhookDelivered || rv.received() != 1 {
+		t.Errorf("status = %s, received %d, want delivered", d.Status, rv.received())
+	}
+}
+
+func TestWebhookRedirect(t *testing.T) {
+	rv := receiver{}
+	target := httptest.NewServer(&rv)
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	wh, store := newTestWebhooks(WebhookOptions{AllowInsecure: true})
+	d := subscribe(t, store, redirect.URL)
+	wh.attempt(d)
+
+	d = delivery(t, store, d.ID)
+	if rv.received() != 0 {
+		t.Error("redirect was followed")
+	}
+	if len(d.Attempts) != 1 || d.Attempts[0].StatusCode != http.StatusTemporaryRedirect || d.Status != WebhookPending {
+		t.Errorf("delivery = %+v, want a failed attempt", d)
+	}
+}
+
+func TestMemoryWebhookStoreClaim(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryWebhookStore(0)
+	now := time.Now().UTC()
+	for i, id := range []string{"a", "b", "c"} {
+		d := WebhookDelivery{ID: id, Status: WebhookPending, NextAttemptAt: now.Add(time.Duration(i) * time.Second)}
+		if err := store.CreateDelivery(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.CreateDelivery(ctx, WebhookDelivery{ID: "delivered", Status: WebhookDelivered, NextAttemptAt: now})
+	store.CreateDelivery(ctx, WebhookDelivery{ID: "later", Status: WebhookPending, NextAttemptAt: now.Add(time.Hour)})
+
+	claim := func(at time.Time, limit int) string {
+		due, err := store.ClaimDueDeliveries(ctx, at, at.Add(time.Minute), limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, d := range due {
+			ids = append(ids, d.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	at := now.Add(5 * time.Second)
+
+	// The longest waiting are claimed first, and not again until their claim
+	// runs out
+	if ids := claim(at, 2); ids != "a,b" {
+		t.Errorf("claimed %q, want a,b", ids)
+	}
+	if ids := claim(at, 2); ids != "c" {
+		t.Errorf("claimed %q, want c", ids)
+	}
+	if ids := claim(at, 2); ids != "" {
+		t.Errorf("claimed %q, want nothing", ids)
+	}
+	if ids := claim(at.Add(time.Minute), 10); ids != "a,b,c" {
+		t.Errorf("claimed %q, want a,b,c once their claims ran out", ids)
+	}
+}
+
+func TestWebhookRun(t *testing.T) {
+	rv := receiver{}
+	ts := httptest.NewServer(&rv)
+	defer ts.Close()
+
+	// Instances sharing a store each deliver some of the events, and every
+	// event is delivered once, without waiting to poll
+	store := NewMemoryWebhookStore(0)
+	opts := WebhookOptions{AllowInsecure: true, Concurrency: 2, PollInterval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	var instances []*Webhooks
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		opts.Registerer = prometheus.NewRegistry()
+		wh := NewWebhooks(store, zap.NewNop().Sugar(), opts)
+		instances = append(instances, wh)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wh.Run(ctx)
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if err := store.CreateSubscription(ctx, WebhookSubscription{ID: "sub", URL: ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	const events = 25
+	for i := 0; i < events; i++ {
+		if err := instances[0].Publish(ctx, "account.created", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wake every instance
+	for _, wh := range instances[1:] {
+		wh.wake <- struct{}{}
+	}
+
+	waitFor(t, "deliveries", func() bool { return rv.received() >= events })
+	time.Sleep(20 * time.Millisecond)
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, r := range rv.requests {
+		id := r.Header.Get(HeaderWebhookID)
+		if seen[id] {
+			t.Errorf("delivery %s received more than once", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != events {
+		t.Errorf("received %d deliveries, want %d", len(seen), events)
+	}
+}
+
+// failingStore is a WebhookStore whose subscriptions can't be read.
+type failingStore struct {
+	*MemoryWebhookStore
+}
+
+// GetSubscription implements WebhookStore
+func (failingStore) GetSubscription(ctx context.Context, id string) (WebhookSubscription, error) {
+	return WebhookSubscription{}, errors.New("store unavailable")
+}
+
+func TestWebhookAttempt(t *testing.T) {
+	rv := receiver{status: http.StatusInternalServerError}
+	ts := httptest.NewServer(&rv)
+	defer ts.Close()
+
+	var log testLog
+	store := NewMemoryWebhookStore(0)
+	wh := NewWebhooks(store, log.logger(), WebhookOptions{
+		AllowInsecure:  true,
+		MaxAttempts:    3,
+		InitialBackoff: time.Minute,
+		Registerer:     prometheus.NewRegistry(),
+	})
+	d := subscribe(t, store, ts.URL)
+
+	// Failed attempts are retried with backoff, until the delivery is dead
+	for i, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		start := time.Now()
+		wh.attempt(d)
+		d = delivery(t, store, d.ID)
+
+		if d.Status != WebhookPending || len(d.Attempts) != i+1 || d.Attempts[i].StatusCode != http.StatusInternalServerError {
+			t.Fatalf("attempt %d: delivery = %+v, want a failed attempt", i+1, d)
+		}
+		if retry := d.NextAttemptAt.Sub(start); retry < backoff || retry > backoff+time.Second {
+			t.Errorf("attempt %d: retried after %s, want %s", i+1, retry, backoff)
+		}
+		if entries := log.entries(); len(entries) != 1 || entries[0].Level != "warn" {
+			t.Errorf("attempt %d: logged %+v, want a warning", i+1, entries)
+		}
+	}
+
+	wh.attempt(d)
+	if d = delivery(t, store, d.ID); d.Status != WebhookDead || len(d.Attempts) != 3 {
+		t.Errorf("delivery = %+v, want it dead", d)
+	}
+	if entries := log.entries(); len(entries) != 1 || entries[0].Level != "error" {
+		t.Errorf("logged %+v, want an error", entries)
+	}
+
+	// Successful attempts are delivered
+	rv.mu.Lock()
+	rv.status = http.StatusNoContent
+	rv.mu.Unlock()
+	store.UpdateDelivery(context.Background(), WebhookDelivery{ID: d.ID, SubscriptionID: "sub", Status: WebhookPending, Payload: d.Payload})
+	wh.attempt(delivery(t, store, d.ID))
+	if d = delivery(t, store, d.ID); d.Status != WebhookDelivered || len(d.Attempts) != 1 {
+		t.Errorf("delivery = %+v, want it delivered", d)
+	}
+	if entries := log.entries(); len(entries) != 1 || entries[0].Level != "info" {
+		t.Errorf("logged %+v, want info", entries)
+	}
+
+	// Deliveries to deleted subscriptions are dead
+	store.UpdateDelivery(context.Background(), WebhookDelivery{ID: d.ID, SubscriptionID: "sub", Status: WebhookPending, Payload: d.Payload})
+	store.DeleteSubscription(context.Background(), "sub")
+	wh.attempt(delivery(t, store, d.ID))
+	if d = delivery(t, store, d.ID); d.Status != WebhookDead || d.Attempts[0].Error != "subscription deleted" {
+		t.Errorf("delivery = %+v, want it dead", d)
+	}
+}
+
+func TestWebhookAttemptStoreError(t *testing.T) {
+	var log testLog
+	store := failingStore{NewMemoryWebhookStore(0)}
+	wh := NewWebhooks(store, log.logger(), WebhookOptions{InitialBackoff: time.Minute, Registerer: prometheus.NewRegistry()})
+	d := subscribe(t, store.MemoryWebhookStore, "https://example.com")
+
+	// Subscriptions that can't be read fail the attempt, so it is retried with
+	// backoff, rather than at every poll
+	start := time.Now()
+	wh.attempt(d)
+	d = delivery(t, store.MemoryWebhookStore, d.ID)
+	if d.Status != WebhookPending || len(d.Attempts) != 1 || !strings.Contains(d.Attempts[0].Error, "store unavailable") {
+		t.Errorf("delivery = %+v, want a failed attempt", d)
+	}
+	if d.NextAttemptAt.Sub(start) < time.Minute {
+		t.Errorf("retried at %s, want after a minute", d.NextAttemptAt)
+	}
+	if entries := log.entries(); len(entries) != 1 || entries[0].Level != "warn" {
+		t.Errorf("logged %+v, want a warning", entries)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	wh, _ := newTestWebhooks(WebhookOptions{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	for attempts, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if attempts == 0 {
+			continue
+		}
+		if got := wh.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"id":"del"}`)
+	now := time.Now()
+	request := func(ts time.Time, sig string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(ts.Unix(), 10))
+		r.Header.Set(HeaderWebhookSignature, sig)
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		body []byte
+		err  error
+	}{
+		{name: "valid", r: request(now, SignWebhook("s3cret", now, body)), body: body},
+		{name: "rotating", r: request(now, SignWebhook("old", now, body)+", "+SignWebhook("s3cret", now, body)), body: body},
+		{name: "wrong secret", r: request(now, SignWebhook("other", now, body)), body: body, err: ErrInvalidSignature},
+		{name: "modified body", r: request(now, SignWebhook("s3cret", now, body)), body: []byte(`{"id":"other"}`), err: ErrInvalidSignature},
+		{name: "replayed", r: request(now.Add(-10*time.Minute), SignWebhook("s3cret", now.Add(-10*time.Minute), body)), body: body, err: ErrInvalidSignature},
+		{name: "missing", r: httptest.NewRequest(http.MethodPost, "/", nil), body: body, err: ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		if err := VerifyWebhook(tt.r, tt.body, "s3cret", 5*time.Minute); err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWebhookSigned(t *testing.T) {
+	rv := receiver{}
+	ts := httptest.NewServer(&rv)
+	defer ts.Close()
+
+	wh, store := newTestWebhooks(WebhookOptions{AllowInsecure: true})
+	d := subscribe(t, store, ts.URL)
+	wh.attempt(d)
+
+	// Deliveries can be verified by their receiver
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if len(rv.requests) != 1 {
+		t.Fatalf("received %d deliveries, want 1", len(rv.requests))
+	}
+	if err := VerifyWebhook(rv.requests[0], rv.bodies[0], "s3cret", time.Minute); err != nil {
+		t.Errorf("delivery couldn't be verified: %v", err)
+	}
+	if id := rv.requests[0].Header.Get(HeaderWebhookID); id != d.ID {
+		t.Errorf("%s = %q, want %q", HeaderWebhookID, id, d.ID)
+	}
+}
@@ -0,0 +1,28 @@
+module github.com/dlmiddlecote/kit
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/ardanlabs/conf v1.3.2
+	github.com/blendle/zapdriver v1.3.1
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/prometheus/client_golang v1.6.0
+	github.com/segmentio/ksuid v1.0.2
+	go.uber.org/zap v1.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.9.1 // indirect
+	github.com/prometheus/procfs v0.0.11 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.0.0-20200420163511-1957bb5e6d1f // indirect
+	google.golang.org/protobuf v1.21.0 // indirect
+)